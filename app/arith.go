@@ -0,0 +1,522 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrDivisionByZero = errors.New("division by 0")
+var ErrArithOverflow = errors.New("integer overflow")
+var ErrArithSyntax = errors.New("syntax error in expression")
+
+// arithTokens lists the operators, longest first so the scanner can take
+// the first prefix that matches.
+var arithTokens = []string{
+	"<<=", ">>=",
+	"**", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "++", "--",
+	"+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "&", "|", "^", "!", "~", "?", ":", "=", ",", "(", ")",
+}
+
+var arithAssignments = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"<<=": true, ">>=": true, "&=": true, "^=": true, "|=": true,
+}
+
+var arithPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+	"**": 11,
+}
+
+const maxArithDepth = 1024
+
+// arithValue is the result of a subexpression. name is set when the
+// subexpression is a bare variable and so can be assigned to.
+type arithValue struct {
+	n    int64
+	name string
+}
+
+// arithParser evaluates an expression while parsing it. While skip is
+// non-zero the operand of a short-circuited operator is being parsed and
+// assignments and errors from it are suppressed.
+type arithParser struct {
+	s     *Shell
+	expr  string
+	pos   int
+	tok   string
+	skip  int
+	depth int
+}
+
+// arithmetic expands parameters and command substitutions in source and
+// evaluates the result, as for $((...)) and ((...)).
+func (s *Shell) arithmetic(source string) (int64, error) {
+	expr, err := (&expander{s: s}).operandString(source, true)
+	if err != nil {
+		return 0, err
+	}
+	return s.evalArith(expr, 0)
+}
+
+func (s *Shell) evalArith(expr string, depth int) (int64, error) {
+	if depth > maxArithDepth {
+		return 0, errors.New("expression recursion level exceeded")
+	}
+
+	p := &arithParser{s: s, expr: expr, depth: depth}
+	if err := p.next(); err != nil {
+		return 0, p.wrap(err)
+	}
+	if p.tok == "" {
+		return 0, nil
+	}
+	v, err := p.parseComma()
+	if err != nil {
+		return 0, p.wrap(err)
+	}
+	if p.tok != "" {
+		return 0, p.wrap(fmt.Errorf("%w (error token is \"%s\")", ErrArithSyntax, p.tok+p.expr[p.pos:]))
+	}
+	return v.n, nil
+}
+
+// arithError is an error in evaluating expr. An error in the value of a
+// variable is reported with that value rather than each enclosing
+// expression.
+type arithError struct {
+	expr string
+	err  error
+}
+
+func (e *arithError) Error() string { return e.expr + ": " + e.err.Error() }
+
+func (e *arithError) Unwrap() error { return e.err }
+
+// wrap names the expression err occurred in, unless an inner expression
+// already is.
+func (p *arithParser) wrap(err error) error {
+	var inner *arithError
+	if errors.As(err, &inner) {
+		return err
+	}
+	return &arithError{expr: strings.TrimSpace(p.expr), err: err}
+}
+
+// next advances to the next token. Numbers and names are returned whole;
+// the empty string marks the end of the expression.
+func (p *arithParser) next() error {
+	for p.pos < len(p.expr) && strings.IndexByte(" \t\n", p.expr[p.pos]) >= 0 {
+		p.pos++
+	}
+	if p.pos >= len(p.expr) {
+		p.tok = ""
+		return nil
+	}
+
+	start := p.pos
+	if c := p.expr[p.pos]; isNameChar(c) {
+		for p.pos < len(p.expr) && (isNameChar(p.expr[p.pos]) || (c >= '0' && c <= '9' && strings.IndexByte("#@", p.expr[p.pos]) >= 0)) {
+			p.pos++
+		}
+		p.tok = p.expr[start:p.pos]
+		return nil
+	}
+
+	for _, op := range arithTokens {
+		if strings.HasPrefix(p.expr[p.pos:], op) {
+			p.pos += len(op)
+			p.tok = op
+			return nil
+		}
+	}
+	return fmt.Errorf("%w (error token is \"%s\")", ErrArithSyntax, p.expr[start:])
+}
+
+func (p *arithParser) expect(tok string) error {
+	if p.tok != tok {
+		return fmt.Errorf("%w: `%s' expected", ErrArithSyntax, tok)
+	}
+	return p.next()
+}
+
+func (p *arithParser) parseComma() (arithValue, error) {
+	v, err := p.parseAssign()
+	for err == nil && p.tok == "," {
+		if err = p.next(); err != nil {
+			break
+		}
+		v, err = p.parseAssign()
+	}
+	return v, err
+}
+
+func (p *arithParser) parseAssign() (arithValue, error) {
+	lhs, err := p.parseTernary()
+	if err != nil {
+		return lhs, err
+	}
+
+	op := p.tok
+	if !arithAssignments[op] {
+		return lhs, nil
+	}
+	if lhs.name == "" {
+		return lhs, fmt.Errorf("attempted assignment to non-variable (error token is \"%s\")", op+p.expr[p.pos:])
+	}
+	if err := p.next(); err != nil {
+		return lhs, err
+	}
+	rhs, err := p.parseAssign()
+	if err != nil {
+		return lhs, err
+	}
+
+	n := rhs.n
+	if op != "=" {
+		if n, err = p.binary(op[:len(op)-1], lhs.n, rhs.n); err != nil {
+			return lhs, err
+		}
+	}
+	p.assign(lhs.name, n)
+	return arithValue{n: n}, nil
+}
+
+func (p *arithParser) parseTernary() (arithValue, error) {
+	cond, err := p.parseBinary(1)
+	if err != nil || p.tok != "?" {
+		return cond, err
+	}
+	if err := p.next(); err != nil {
+		return cond, err
+	}
+
+	if cond.n == 0 {
+		p.skip++
+	}
+	then, err := p.parseAssign()
+	if cond.n == 0 {
+		p.skip--
+	}
+	if err != nil {
+		return then, err
+	}
+	if err := p.expect(":"); err != nil {
+		return then, err
+	}
+
+	if cond.n != 0 {
+		p.skip++
+	}
+	otherwise, err := p.parseTernary()
+	if cond.n != 0 {
+		p.skip--
+	}
+	if err != nil {
+		return otherwise, err
+	}
+
+	if cond.n != 0 {
+		return arithValue{n: then.n}, nil
+	}
+	return arithValue{n: otherwise.n}, nil
+}
+
+func (p *arithParser) parseBinary(minPrec int) (arithValue, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return lhs, err
+	}
+
+	for {
+		op := p.tok
+		prec, ok := arithPrecedence[op]
+		if !ok || prec < minPrec {
+			return lhs, nil
+		}
+		if err := p.next(); err != nil {
+			return lhs, err
+		}
+
+		// ** is right associative, everything else left associative
+		nextPrec := prec + 1
+		if op == "**" {
+			nextPrec = prec
+		}
+
+		shortCircuit := (op == "&&" && lhs.n == 0) || (op == "||" && lhs.n != 0)
+		if shortCircuit {
+			p.skip++
+		}
+		rhs, err := p.parseBinary(nextPrec)
+		if shortCircuit {
+			p.skip--
+		}
+		if err != nil {
+			return lhs, err
+		}
+
+		n, err := p.binary(op, lhs.n, rhs.n)
+		if err != nil {
+			return lhs, err
+		}
+		lhs = arithValue{n: n}
+	}
+}
+
+func (p *arithParser) parseUnary() (arithValue, error) {
+	op := p.tok
+	switch op {
+	case "!", "~", "-", "+":
+		if err := p.next(); err != nil {
+			return arithValue{}, err
+		}
+		v, err := p.parseUnary()
+		if err != nil {
+			return v, err
+		}
+		switch op {
+		case "!":
+			return arithValue{n: boolToInt(v.n == 0)}, nil
+		case "~":
+			return arithValue{n: ^v.n}, nil
+		case "-":
+			return arithValue{n: -v.n}, nil
+		}
+		return arithValue{n: v.n}, nil
+
+	case "++", "--":
+		if err := p.next(); err != nil {
+			return arithValue{}, err
+		}
+		v, err := p.parseUnary()
+		if err != nil {
+			return v, err
+		}
+		if v.name == "" {
+			return v, fmt.Errorf("%w: %s requires a variable", ErrArithSyntax, op)
+		}
+		n := v.n + 1
+		if op == "--" {
+			n = v.n - 1
+		}
+		p.assign(v.name, n)
+		return arithValue{n: n}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+func (p *arithParser) parsePostfix() (arithValue, error) {
+	v, err := p.parsePrimary()
+	if err != nil || v.name == "" || (p.tok != "++" && p.tok != "--") {
+		return v, err
+	}
+
+	n := v.n + 1
+	if p.tok == "--" {
+		n = v.n - 1
+	}
+	p.assign(v.name, n)
+	return arithValue{n: v.n}, p.next()
+}
+
+func (p *arithParser) parsePrimary() (arithValue, error) {
+	tok := p.tok
+	switch {
+	case tok == "(":
+		if err := p.next(); err != nil {
+			return arithValue{}, err
+		}
+		v, err := p.parseComma()
+		if err != nil {
+			return v, err
+		}
+		return arithValue{n: v.n}, p.expect(")")
+
+	case tok == "":
+		return arithValue{}, fmt.Errorf("%w: operand expected", ErrArithSyntax)
+
+	case tok[0] >= '0' && tok[0] <= '9':
+		n, err := parseArithNumber(tok)
+		if err != nil {
+			return arithValue{}, err
+		}
+		return arithValue{n: n}, p.next()
+
+	case isNameStart(tok[0]):
+		n, err := p.variable(tok)
+		if err != nil {
+			return arithValue{}, err
+		}
+		return arithValue{n: n, name: tok}, p.next()
+	}
+	return arithValue{}, fmt.Errorf("%w (error token is \"%s\")", ErrArithSyntax, tok+p.expr[p.pos:])
+}
+
+// variable returns the numeric value of a variable. A value that is not a
+// number is itself evaluated as an expression; unset and empty variables
+// are zero.
+func (p *arithParser) variable(name string) (int64, error) {
+	value, _ := p.s.getVar(name)
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if n, err := parseArithNumber(value); err == nil {
+		return n, nil
+	}
+	if p.skip > 0 {
+		return 0, nil
+	}
+	return p.s.evalArith(value, p.depth+1)
+}
+
+func (p *arithParser) assign(name string, n int64) {
+	if p.skip == 0 {
+		p.s.setVar(name, strconv.FormatInt(n, 10))
+	}
+}
+
+func (p *arithParser) binary(op string, a, b int64) (int64, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			if p.skip > 0 {
+				return 0, nil
+			}
+			return 0, ErrDivisionByZero
+		}
+		if a == math.MinInt64 && b == -1 {
+			if p.skip > 0 {
+				return 0, nil
+			}
+			return 0, ErrArithOverflow
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	case "**":
+		if b < 0 {
+			if p.skip > 0 {
+				return 0, nil
+			}
+			return 0, errors.New("exponent less than 0")
+		}
+		// by squaring, so that large exponents take few steps
+		result := int64(1)
+		for ; b > 0; b >>= 1 {
+			if b&1 == 1 {
+				result *= a
+			}
+			a *= a
+		}
+		return result, nil
+	case "<<":
+		return a << (uint64(b) & 63), nil
+	case ">>":
+		return a >> (uint64(b) & 63), nil
+	case "&":
+		return a & b, nil
+	case "|":
+		return a | b, nil
+	case "^":
+		return a ^ b, nil
+	case "&&":
+		return boolToInt(a != 0 && b != 0), nil
+	case "||":
+		return boolToInt(a != 0 || b != 0), nil
+	case "==":
+		return boolToInt(a == b), nil
+	case "!=":
+		return boolToInt(a != b), nil
+	case "<":
+		return boolToInt(a < b), nil
+	case ">":
+		return boolToInt(a > b), nil
+	case "<=":
+		return boolToInt(a <= b), nil
+	case ">=":
+		return boolToInt(a >= b), nil
+	}
+	return 0, fmt.Errorf("%w: unknown operator %s", ErrArithSyntax, op)
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseArithNumber parses a decimal, 0x hexadecimal, 0 octal or base#digits
+// integer constant. Bases above 36 use a-z, A-Z, @ and _ as digits.
+func parseArithNumber(tok string) (int64, error) {
+	base := int64(10)
+	digits := tok
+	if b, rest, ok := strings.Cut(tok, "#"); ok {
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 2 || n > 64 {
+			return 0, errors.New("invalid arithmetic base")
+		}
+		base, digits = int64(n), rest
+	} else if len(tok) > 1 && tok[0] == '0' && (tok[1] == 'x' || tok[1] == 'X') {
+		base, digits = 16, tok[2:]
+	} else if len(tok) > 1 && tok[0] == '0' {
+		base, digits = 8, tok[1:]
+	}
+	if digits == "" {
+		return 0, errors.New("invalid number")
+	}
+
+	var n int64
+	for i := 0; i < len(digits); i++ {
+		d := arithDigit(digits[i], base)
+		if d < 0 || d >= base {
+			return 0, fmt.Errorf("value too great for base (error token is \"%s\")", tok)
+		}
+		if n > (math.MaxInt64-d)/base {
+			return 0, ErrArithOverflow
+		}
+		n = n*base + d
+	}
+	return n, nil
+}
+
+func arithDigit(c byte, base int64) int64 {
+	switch {
+	case c >= '0' && c <= '9':
+		return int64(c - '0')
+	case c >= 'a' && c <= 'z':
+		return int64(c-'a') + 10
+	case c >= 'A' && c <= 'Z':
+		if base <= 36 {
+			return int64(c-'A') + 10
+		}
+		return int64(c-'A') + 36
+	case c == '@':
+		return 62
+	case c == '_':
+		return 63
+	}
+	return -1
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"2 ** 10", 1024},
+		{"3 ** 0", 1},
+		{"-2 ** 3", -8},
+		{"1 ** 9223372036854775807", 1},
+		{"(1) + 2", 3},
+	}
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		got, err := s.arithmetic(test.expr)
+		if err != nil || got != test.want {
+			t.Errorf("%s = %d, %v; want %d", test.expr, got, err, test.want)
+		}
+	}
+}
+
+// TestArithmeticErrorNamesExpression checks that an error is prefixed once,
+// with the expression it occurred in.
+func TestArithmeticErrorNamesExpression(t *testing.T) {
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setVar("a", "a")
+	s.setVar("b", "1+")
+	tests := map[string]string{
+		"a": "a: expression recursion level exceeded",
+		"b": "1+: syntax error in expression: operand expected",
+	}
+	for expr, want := range tests {
+		_, err := s.arithmetic(expr)
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: error %v, want %q", expr, err, want)
+		}
+	}
+}
+
+// TestArithmeticOrCommandSubstitution checks that $(( is only arithmetic
+// when the parentheses closing it are the pair that opened it, as in bash.
+func TestArithmeticOrCommandSubstitution(t *testing.T) {
+	tests := map[string]string{
+		"$(( (1) + 2 ))":      "3",
+		"$( (echo sub) )":     "sub",
+		"$((echo a); echo b)": "a b",
+		"$((echo c) )":        "c",
+	}
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for source, want := range tests {
+		fields, err := s.expandWords([]*Word{parseWord(t, s, source)})
+		if err != nil || strings.Join(fields, " ") != want {
+			t.Errorf("%s expands to %q, %v; want %q", source, fields, err, want)
+		}
+	}
+}
+
+// parseWord returns the single word of source.
+func parseWord(t *testing.T, s *Shell, source string) *Word {
+	t.Helper()
+	list, err := s.ParseInput("echo " + source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list.Items[0].AndOr.Pipelines[0].Commands[0].(*SimpleCommand).Words[1]
+}
@@ -0,0 +1,340 @@
+package main
+
+import "strings"
+
+// Node is an element of the syntax tree built by ParseInput. String
+// reproduces the source form and is used for job listings.
+type Node interface {
+	String() string
+}
+
+// SimpleCommand is a command name with its arguments, optionally preceded
+// by variable assignments, together with its redirections.
+type SimpleCommand struct {
+	Assignments  []*Word
+	Words        []*Word
+	Redirections []Redirection
+}
+
+// PipeSequence is one or more commands joined by | or |&.
+type PipeSequence struct {
+	Commands []Node
+	// PipeStderr[i] is set when Commands[i] is joined to Commands[i+1] with |&.
+	PipeStderr []bool
+	// Negated is set for a pipeline preceded by !, whose status is inverted.
+	Negated bool
+}
+
+// AndOrList is a chain of pipelines joined by && and ||, evaluated left to
+// right with equal precedence.
+type AndOrList struct {
+	Pipelines []*PipeSequence
+	Operators []TokenType
+}
+
+type ListItem struct {
+	AndOr      *AndOrList
+	Background bool
+}
+
+// CommandList is a sequence of and-or lists separated by ; or &.
+type CommandList struct {
+	Items []*ListItem
+}
+
+// CompoundCommand is a compound construct with the redirections that apply
+// to it as a whole.
+type CompoundCommand struct {
+	Body         Node
+	Redirections []Redirection
+}
+
+// ArithCommand is the ((expression)) command.
+type ArithCommand struct {
+	Expr string
+}
+
+// IfClause is an if command. Bodies[i] runs when Conditions[i] is the
+// first condition to succeed, and Else when none does.
+type IfClause struct {
+	Conditions []*CommandList
+	Bodies     []*CommandList
+	Else       *CommandList
+}
+
+// BraceGroup is a { list; } group, run in the current shell.
+type BraceGroup struct {
+	Body *CommandList
+}
+
+// Subshell is a ( list ) run in a copy of the shell state.
+type Subshell struct {
+	Body *CommandList
+}
+
+// FunctionDef is a function definition. Running it stores the function,
+// whose body runs each time it is called.
+type FunctionDef struct {
+	Name string
+	Body *CompoundCommand
+}
+
+// CaseClause is a case command. Word is matched against the patterns of
+// each item in turn.
+type CaseClause struct {
+	Word  *Word
+	Items []*CaseItem
+}
+
+// CaseItem is a list of patterns with the commands run when one matches.
+// Terminator is the ;;, ;& or ;;& that ends the item.
+type CaseItem struct {
+	Patterns   []*Word
+	Body       *CommandList
+	Terminator TokenType
+}
+
+// ForClause is a for name [in words] loop. Words is nil when the in part
+// is missing and the loop runs over the positional parameters.
+type ForClause struct {
+	Name  string
+	Words []*Word
+	Body  *CommandList
+}
+
+// ArithForClause is the C-style for ((init; condition; update)) loop. An
+// empty condition is always true.
+type ArithForClause struct {
+	Init      string
+	Condition string
+	Update    string
+	Body      *CommandList
+}
+
+// WhileClause is a while loop, or an until loop when Until is set, which
+// runs Body for as long as Condition succeeds (or fails).
+type WhileClause struct {
+	Condition *CommandList
+	Body      *CommandList
+	Until     bool
+}
+
+func (c *SimpleCommand) String() string {
+	var parts []string
+	for _, w := range c.Assignments {
+		parts = append(parts, w.String())
+	}
+	for _, w := range c.Words {
+		parts = append(parts, w.String())
+	}
+	for _, r := range c.Redirections {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *PipeSequence) String() string {
+	var sb strings.Builder
+	if p.Negated {
+		sb.WriteString("! ")
+	}
+	for i, cmd := range p.Commands {
+		if i > 0 {
+			if p.PipeStderr[i-1] {
+				sb.WriteString(" |& ")
+			} else {
+				sb.WriteString(" | ")
+			}
+		}
+		sb.WriteString(cmd.String())
+	}
+	return sb.String()
+}
+
+func (a *AndOrList) String() string {
+	var sb strings.Builder
+	for i, p := range a.Pipelines {
+		if i > 0 {
+			if a.Operators[i-1] == TokenAnd {
+				sb.WriteString(" && ")
+			} else {
+				sb.WriteString(" || ")
+			}
+		}
+		sb.WriteString(p.String())
+	}
+	return sb.String()
+}
+
+func (l *CommandList) String() string {
+	var sb strings.Builder
+	for i, item := range l.Items {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(item.AndOr.String())
+		if item.Background {
+			sb.WriteString(" &")
+		} else if i < len(l.Items)-1 {
+			sb.WriteString(";")
+		}
+		// the here-documents of the item follow it on the next lines
+		if docs := hereDocuments(item.AndOr); len(docs) > 0 {
+			sb.WriteString("\n")
+			for _, doc := range docs {
+				sb.WriteString(doc.Document())
+			}
+		}
+	}
+	return sb.String()
+}
+
+// hereDocuments returns the << redirections of the commands of a, in
+// order. Those inside nested lists are written out by those lists.
+func hereDocuments(a *AndOrList) []*HereRedirection {
+	var docs []*HereRedirection
+	add := func(redirections []Redirection) {
+		for _, r := range redirections {
+			if here, ok := r.(*HereRedirection); ok && here.Operator != "<<<" {
+				docs = append(docs, here)
+			}
+		}
+	}
+	for _, p := range a.Pipelines {
+		for _, cmd := range p.Commands {
+			switch c := cmd.(type) {
+			case *SimpleCommand:
+				add(c.Redirections)
+			case *CompoundCommand:
+				add(c.Redirections)
+			case *FunctionDef:
+				add(c.Body.Redirections)
+			}
+		}
+	}
+	return docs
+}
+
+func (c *CompoundCommand) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.Body.String())
+	for _, r := range c.Redirections {
+		sb.WriteString(" ")
+		sb.WriteString(r.String())
+	}
+	return sb.String()
+}
+
+func (c *ArithCommand) String() string {
+	return "((" + c.Expr + "))"
+}
+
+func (c *IfClause) String() string {
+	var sb strings.Builder
+	for i, condition := range c.Conditions {
+		if i == 0 {
+			sb.WriteString("if ")
+		} else {
+			sb.WriteString("elif ")
+		}
+		sb.WriteString(terminatedList(condition))
+		sb.WriteString(" then ")
+		sb.WriteString(terminatedList(c.Bodies[i]))
+		sb.WriteString(" ")
+	}
+	if c.Else != nil {
+		sb.WriteString("else ")
+		sb.WriteString(terminatedList(c.Else))
+		sb.WriteString(" ")
+	}
+	sb.WriteString("fi")
+	return sb.String()
+}
+
+func (g *BraceGroup) String() string {
+	return "{ " + terminatedList(g.Body) + " }"
+}
+
+func (c *Subshell) String() string {
+	return "( " + c.Body.String() + " )"
+}
+
+func (f *FunctionDef) String() string {
+	return f.Name + " () " + f.Body.String()
+}
+
+func (c *CaseClause) String() string {
+	var sb strings.Builder
+	sb.WriteString("case ")
+	sb.WriteString(c.Word.String())
+	sb.WriteString(" in")
+	for _, item := range c.Items {
+		sb.WriteString(" ")
+		sb.WriteString(item.String())
+	}
+	sb.WriteString(" esac")
+	return sb.String()
+}
+
+func (c *CaseItem) String() string {
+	var sb strings.Builder
+	for i, pattern := range c.Patterns {
+		if i > 0 {
+			sb.WriteString("|")
+		}
+		sb.WriteString(pattern.String())
+	}
+	sb.WriteString(")")
+	if len(c.Body.Items) > 0 {
+		sb.WriteString(" ")
+		sb.WriteString(c.Body.String())
+	}
+	switch c.Terminator {
+	case TokenSemicolonAnd:
+		sb.WriteString(";&")
+	case TokenDoubleSemicolonAnd:
+		sb.WriteString(";;&")
+	default:
+		sb.WriteString(";;")
+	}
+	return sb.String()
+}
+
+func (c *ForClause) String() string {
+	var sb strings.Builder
+	sb.WriteString("for ")
+	sb.WriteString(c.Name)
+	if c.Words != nil {
+		sb.WriteString(" in")
+		for _, w := range c.Words {
+			sb.WriteString(" ")
+			sb.WriteString(w.String())
+		}
+	}
+	sb.WriteString("; do ")
+	sb.WriteString(terminatedList(c.Body))
+	sb.WriteString(" done")
+	return sb.String()
+}
+
+func (c *ArithForClause) String() string {
+	return "for ((" + c.Init + "; " + c.Condition + "; " + c.Update + ")); do " + terminatedList(c.Body) + " done"
+}
+
+func (c *WhileClause) String() string {
+	keyword := "while "
+	if c.Until {
+		keyword = "until "
+	}
+	return keyword + terminatedList(c.Condition) + " do " + terminatedList(c.Body) + " done"
+}
+
+// terminatedList writes a list followed by ; unless it already ends in &
+// or with a here-document, as it appears before a reserved word.
+func terminatedList(l *CommandList) string {
+	text := l.String()
+	if n := len(l.Items); (n > 0 && l.Items[n-1].Background) || strings.HasSuffix(text, "\n") {
+		return text
+	}
+	return text + ";"
+}
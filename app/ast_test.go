@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+// TestStringRoundTrip checks that every kind of node prints as source that
+// parses back to the same tree, as subshells run in a process of their own
+// are given the functions and the list to run in that form.
+func TestStringRoundTrip(t *testing.T) {
+	inputs := []string{
+		"echo hello world",
+		"x=1 y='a b' env > out 2>&1 < in",
+		"cmd 3<> file 4>&- 5<&0 >| clobber >> append &> both",
+		"a | b |& c",
+		"a && b || ! c",
+		"! a | b; ! { a; } > out",
+		"a; b & c",
+		"sleep 1 &",
+		"(( x += 2 ))",
+		"if a; then b; elif c; then d; else e; fi",
+		"{ a; b; } > out",
+		"( cd /tmp; ls ) | wc -l",
+		"f() { local x=1; return 2; }",
+		"function g { echo \"$@\"; }",
+		"case $x in a|b) echo ab;; c) echo c;& *) ;;& esac",
+		"for i in 1 2 \"3 4\"; do echo $i; done",
+		"for i; do echo $i; done",
+		"for ((i = 0; i < 3; i++)); do echo $i; done",
+		"while read l; do echo \"[$l]\"; done < file",
+		"until false; do break; done",
+		"echo $(echo hi) `echo there` ${x:-default} $((1 + 2)) <(cat) >(cat)",
+		"cat <<< \"here string\"",
+		"cat <<EOF | tr a-z A-Z; echo after\nhello $USER\nEOF",
+		"cat <<'EOF'\nno $expansion\nEOF",
+		"cat <<-EOF\n\tstripped\n\tEOF",
+		"f() { cat <<A; cat <<B; }\none\nA\ntwo\nB",
+		"while read l; do echo $l; done <<X\na\nX",
+		"case y in y) cat <<E\nin case\nE\n;; esac",
+		"if cat <<E; then echo yes; fi\ncond\nE",
+		"echo @(a|b) !(c)",
+	}
+
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.shopts["extglob"] = true
+	for _, input := range inputs {
+		list, err := s.ParseInput(input)
+		if err != nil {
+			t.Errorf("parsing %q: %v", input, err)
+			continue
+		}
+		printed := list.String()
+		reparsed, err := s.ParseInput(printed)
+		if err != nil {
+			t.Errorf("parsing %q printed from %q: %v", printed, input, err)
+			continue
+		}
+		if again := reparsed.String(); again != printed {
+			t.Errorf("%q printed as %q, which prints as %q", input, printed, again)
+		}
+	}
+}
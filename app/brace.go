@@ -0,0 +1,220 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// braceItem is a unit of a word as seen by brace expansion: a single
+// unquoted character, a whole quoted part, or a whole ${...}, $(...) or
+// `...` expansion. Only unquoted characters can form brace syntax.
+type braceItem struct {
+	text  string
+	quote QuoteKind
+	// syntax is set for unquoted characters, the only ones that can be
+	// braces, commas or part of a sequence.
+	syntax bool
+}
+
+var braceSequenceRe = regexp.MustCompile(`^(-?\d+|[a-zA-Z])\.\.(-?\d+|[a-zA-Z])(?:\.\.(-?\d+))?$`)
+
+// expandBraces performs brace expansion on w, returning the words it
+// produces in order. A word without brace syntax is returned unchanged.
+func expandBraces(w *Word) []*Word {
+	if !strings.Contains(w.Raw, "{") {
+		return []*Word{w}
+	}
+
+	var words []*Word
+	for _, items := range braceExpand(braceItems(w)) {
+		word := &Word{Raw: w.Raw}
+		for _, item := range items {
+			word.addPart(item.text, item.quote)
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+func braceItems(w *Word) []braceItem {
+	var items []braceItem
+	for _, part := range w.Parts {
+		if part.Quote != Unquoted {
+			items = append(items, braceItem{text: part.Text, quote: part.Quote})
+			continue
+		}
+
+		text := part.Text
+		for i := 0; i < len(text); {
+			end := -1
+			switch {
+			case text[i] == '`':
+				end = closingBacktick(text[i:])
+				if end >= 0 {
+					end += i
+				}
+			case text[i] == '$' && i+1 < len(text) && (text[i+1] == '{' || text[i+1] == '('):
+				end = matchingClose(text, i+1)
+			}
+			if end >= 0 {
+				items = append(items, braceItem{text: text[i : end+1], quote: Unquoted})
+				i = end + 1
+				continue
+			}
+
+			n := len(string([]rune(text[i:])[0]))
+			items = append(items, braceItem{text: text[i : i+n], quote: Unquoted, syntax: true})
+			i += n
+		}
+	}
+	return items
+}
+
+func (item braceItem) is(c string) bool {
+	return item.syntax && item.text == c
+}
+
+// braceExpand expands the first brace expression in items that holds a
+// comma at its top level or is a valid sequence, then expands each of
+// the results again for the braces that remain.
+func braceExpand(items []braceItem) [][]braceItem {
+	for open := range items {
+		if !items[open].is("{") {
+			continue
+		}
+		close, commas := braceClose(items, open)
+		if close < 0 {
+			continue
+		}
+
+		var alternatives [][]braceItem
+		if len(commas) > 0 {
+			start := open + 1
+			for _, comma := range append(commas, close) {
+				alternatives = append(alternatives, items[start:comma])
+				start = comma + 1
+			}
+		} else if alternatives = braceSequence(items[open+1 : close]); alternatives == nil {
+			continue
+		}
+
+		var result [][]braceItem
+		for _, alt := range alternatives {
+			expanded := make([]braceItem, 0, len(items))
+			expanded = append(expanded, items[:open]...)
+			expanded = append(expanded, alt...)
+			expanded = append(expanded, items[close+1:]...)
+			result = append(result, braceExpand(expanded)...)
+		}
+		return result
+	}
+	return [][]braceItem{items}
+}
+
+// braceClose returns the index of the } matching the { at items[open]
+// and the indexes of the commas directly inside it.
+func braceClose(items []braceItem, open int) (int, []int) {
+	depth := 0
+	var commas []int
+	for i := open; i < len(items); i++ {
+		switch {
+		case items[i].is("{"):
+			depth++
+		case items[i].is("}"):
+			depth--
+			if depth == 0 {
+				return i, commas
+			}
+		case items[i].is(",") && depth == 1:
+			commas = append(commas, i)
+		}
+	}
+	return -1, nil
+}
+
+// braceSequence returns the words of a {x..y[..step]} sequence of
+// integers or letters, or nil when items do not hold one. Integers are
+// zero padded to the widest bound when either bound has a leading zero.
+func braceSequence(items []braceItem) [][]braceItem {
+	var sb strings.Builder
+	for _, item := range items {
+		if !item.syntax {
+			return nil
+		}
+		sb.WriteString(item.text)
+	}
+	m := braceSequenceRe.FindStringSubmatch(sb.String())
+	if m == nil {
+		return nil
+	}
+
+	step := 1
+	if m[3] != "" {
+		n, err := strconv.Atoi(m[3])
+		if err != nil {
+			return nil
+		}
+		step = max(n, -n, 1)
+	}
+
+	var values []string
+	first, errFirst := strconv.Atoi(m[1])
+	last, errLast := strconv.Atoi(m[2])
+	switch {
+	case errFirst == nil && errLast == nil:
+		width := 0
+		if hasLeadingZero(m[1]) || hasLeadingZero(m[2]) {
+			width = max(len(m[1]), len(m[2]))
+		}
+		for _, n := range braceRange(first, last, step) {
+			values = append(values, padNumber(n, width))
+		}
+	case errFirst != nil && errLast != nil:
+		for _, n := range braceRange(int(m[1][0]), int(m[2][0]), step) {
+			values = append(values, string(rune(n)))
+		}
+	default:
+		return nil
+	}
+
+	// letter ranges can cross punctuation such as ` and \, which must not
+	// be expanded again
+	result := make([][]braceItem, len(values))
+	for i, v := range values {
+		result[i] = []braceItem{{text: v, quote: SingleQuoted}}
+	}
+	return result
+}
+
+func braceRange(first, last, step int) []int {
+	var values []int
+	if first <= last {
+		for n := first; n <= last; n += step {
+			values = append(values, n)
+		}
+	} else {
+		for n := first; n >= last; n -= step {
+			values = append(values, n)
+		}
+	}
+	return values
+}
+
+func hasLeadingZero(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return len(s) > 1 && s[0] == '0'
+}
+
+func padNumber(n, width int) string {
+	digits := strconv.Itoa(max(n, -n))
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		width--
+	}
+	if len(digits) < width {
+		digits = strings.Repeat("0", width-len(digits)) + digits
+	}
+	return sign + digits
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestExpandBraces checks lists, nesting, sequences and that quoted or
+// unbalanced braces are left alone.
+func TestExpandBraces(t *testing.T) {
+	tests := map[string]string{
+		"a{b,c}d":        "abd acd",
+		"{a,b}{1,2}":     "a1 a2 b1 b2",
+		"x{a,{b,c}y}":    "xa xby xcy",
+		"{a,}":           "a",
+		"{1..4}":         "1 2 3 4",
+		"{3..1}":         "3 2 1",
+		"{-1..1}":        "-1 0 1",
+		"{01..10..3}":    "01 04 07 10",
+		"{-05..5..5}":    "-05 000 005",
+		"{a..e..2}":      "a c e",
+		"{1..a}":         "{1..a}",
+		"{a}":            "{a}",
+		"{a,b":           "{a,b",
+		"'{a,b}'":        "{a,b}",
+		"\"{\"a,b}":      "{a,b}",
+		"\\{a,b}":        "{a,b}",
+		"{a,\"b c\"}":    "a b c",
+		"{'x,y',z}":      "x,y z",
+		"${u:-{a,b}}":    "{a,b}",
+		"{$(echo a),b}":  "a b",
+		"pre{1..2}{x,y}": "pre1x pre1y pre2x pre2y",
+	}
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for source, want := range tests {
+		fields, err := s.expandWords([]*Word{parseWord(t, s, source)})
+		if err != nil || strings.Join(fields, " ") != want {
+			t.Errorf("%q expands to %q, %v; want %q", source, fields, err, want)
+		}
+	}
+}
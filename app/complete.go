@@ -0,0 +1,339 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// completion is one candidate for the word being completed.
+type completion struct {
+	// word replaces the word, quoted as the shell needs to read it back.
+	word string
+	// display names the candidate when the candidates are listed.
+	display string
+}
+
+// commandWords are the reserved words after which a command name follows.
+var commandWords = map[string]bool{
+	"if": true, "then": true, "elif": true, "else": true, "while": true,
+	"until": true, "do": true, "!": true, "{": true,
+}
+
+// jobSpecCommands are the builtins that take job specs.
+var jobSpecCommands = map[string]bool{
+	"fg": true, "bg": true, "kill": true, "wait": true, "disown": true, "jobs": true,
+}
+
+// complete is the terminal's AutoCompleteCallback. Tab completes the word
+// before the cursor as far as its candidates agree, and a second Tab in a
+// row lists them when they don't.
+func (s *Shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		s.tabs = 0
+		return "", 0, false
+	}
+	s.tabs++
+
+	start := wordStart(line[:pos])
+	word := line[start:pos]
+	candidates := s.completions(line[:start], word)
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	replacement := candidates[0].word
+	if len(candidates) == 1 {
+		if !strings.HasSuffix(replacement, "/") {
+			replacement += " "
+		}
+	} else {
+		for _, c := range candidates[1:] {
+			replacement = commonPrefix(replacement, c.word)
+		}
+		if len(replacement) <= len(word) {
+			if s.tabs > 1 {
+				s.listCompletions(candidates)
+			}
+			return "", 0, false
+		}
+	}
+	return line[:start] + replacement + line[pos:], start + len(replacement), true
+}
+
+// completions returns the candidates for word, given the line before it.
+func (s *Shell) completions(before, word string) []completion {
+	var candidates []completion
+	switch i := strings.LastIndex(word, "$"); {
+	case i >= 0 && isPartialName(strings.TrimPrefix(word[i+1:], "{")):
+		candidates = s.completeVariable(word[:i], word[i+1:])
+	case strings.HasPrefix(word, "%") || (word == "" && jobSpecCommands[commandName(before)]):
+		candidates = s.completeJobSpec(word)
+	case isCommandPosition(before) && !strings.Contains(word, "/"):
+		candidates = s.completeCommand(unquoteWord(word))
+	default:
+		candidates = s.completeFile(unquoteWord(word))
+	}
+	slices.SortFunc(candidates, func(a, b completion) int { return strings.Compare(a.display, b.display) })
+	return slices.CompactFunc(candidates, func(a, b completion) bool { return a.word == b.word })
+}
+
+// completeVariable completes the variable named after the $ that follows
+// prefix, with or without braces.
+func (s *Shell) completeVariable(prefix, partial string) []completion {
+	braced := strings.HasPrefix(partial, "{")
+	partial = strings.TrimPrefix(partial, "{")
+	var candidates []completion
+	for name := range s.env {
+		if !strings.HasPrefix(name, partial) {
+			continue
+		}
+		word := prefix + "$" + name
+		if braced {
+			word = prefix + "${" + name + "}"
+		}
+		candidates = append(candidates, completion{word: word, display: name})
+	}
+	return candidates
+}
+
+// completeJobSpec completes %n job specs from the job table.
+func (s *Shell) completeJobSpec(word string) []completion {
+	var candidates []completion
+	for _, job := range s.sortedJobs() {
+		spec := "%" + strconv.Itoa(job.ID)
+		if strings.HasPrefix(spec, word) {
+			candidates = append(candidates, completion{word: spec, display: spec + "  " + job.Text})
+		}
+	}
+	return candidates
+}
+
+// completeCommand completes a command name from the builtins, the functions
+// and the executables in the directories of $PATH.
+func (s *Shell) completeCommand(partial string) []completion {
+	var candidates []completion
+	add := func(name string) {
+		if strings.HasPrefix(name, partial) {
+			candidates = append(candidates, completion{word: escapeWord(name), display: name})
+		}
+	}
+	for name := range s.builtins {
+		add(name)
+	}
+	for name := range s.functions {
+		add(name)
+	}
+	pathList, _ := s.getVar("PATH")
+	for _, dir := range pathDirs(pathList) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), partial) {
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(dir, entry.Name())); err == nil && !info.IsDir() && info.Mode().Perm()&0111 != 0 {
+				add(entry.Name())
+			}
+		}
+	}
+	return candidates
+}
+
+// completeFile completes a file or directory name. Directories end in a
+// slash, and names starting with a dot are only offered when partial's
+// last component does.
+func (s *Shell) completeFile(partial string) []completion {
+	dir, base := "", partial
+	if i := strings.LastIndex(partial, "/"); i >= 0 {
+		dir, base = partial[:i+1], partial[i+1:]
+	}
+
+	// a leading ~ is kept unquoted so that it's still expanded
+	tilde, searchDir := "", dir
+	if strings.HasPrefix(dir, "~/") {
+		home, _ := s.getVar("HOME")
+		tilde, dir, searchDir = "~/", dir[2:], filepath.Join(home, dir[2:])
+	}
+	if !filepath.IsAbs(searchDir) {
+		searchDir = filepath.Join(s.workingDir, searchDir)
+	}
+
+	entries, err := os.ReadDir(searchDir)
+	if err != nil {
+		return nil
+	}
+	var candidates []completion
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(searchDir, name)); err == nil && info.IsDir() {
+			name += "/"
+		}
+		candidates = append(candidates, completion{word: tilde + escapeWord(dir+name), display: name})
+	}
+	return candidates
+}
+
+// listCompletions writes the candidates in columns across the terminal,
+// which redraws the prompt and the line below them.
+func (s *Shell) listCompletions(candidates []completion) {
+	width, _, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	columnWidth := 0
+	for _, c := range candidates {
+		columnWidth = max(columnWidth, utf8.RuneCountInString(c.display)+2)
+	}
+	columns := max(1, width/columnWidth)
+	rows := (len(candidates) + columns - 1) / columns
+
+	var sb strings.Builder
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns; column++ {
+			i := column*rows + row
+			if i >= len(candidates) {
+				break
+			}
+			display := candidates[i].display
+			if column < columns-1 && i+rows < len(candidates) {
+				display += strings.Repeat(" ", columnWidth-utf8.RuneCountInString(display))
+			}
+			sb.WriteString(display)
+		}
+		sb.WriteString("\n")
+	}
+	s.Write(os.Stdout, sb.String())
+}
+
+// wordStart returns where the last word of line starts: after the last
+// blank or operator character that isn't quoted or escaped.
+func wordStart(line string) int {
+	start := 0
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' {
+				escaped = true
+			}
+		case r == '\\':
+			escaped = true
+		case r == '\'' || r == '"':
+			quote = r
+		case strings.ContainsRune(" \t\n|&;<>()", r):
+			start = i + 1
+		}
+	}
+	return start
+}
+
+// lastCommand returns the text of the simple command that line ends in.
+func lastCommand(line string) string {
+	return line[strings.LastIndexAny(line, "|&;()\n")+1:]
+}
+
+// isCommandPosition reports whether a word following before is a command
+// name: only reserved words and assignments precede it in its command.
+func isCommandPosition(before string) bool {
+	for _, field := range strings.Fields(lastCommand(before)) {
+		if !commandWords[field] && !assignmentRe.MatchString(field) {
+			return false
+		}
+	}
+	return true
+}
+
+// commandName returns the name of the command that before ends in.
+func commandName(before string) string {
+	for _, field := range strings.Fields(lastCommand(before)) {
+		if !commandWords[field] && !assignmentRe.MatchString(field) {
+			return unquoteWord(field)
+		}
+	}
+	return ""
+}
+
+// isPartialName reports whether s can start a variable name.
+func isPartialName(s string) bool {
+	return s == "" || isName(s)
+}
+
+// unquoteWord removes the quotes and backslashes from a word as typed,
+// which may end inside a quote.
+func unquoteWord(word string) string {
+	var sb strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range word {
+		switch {
+		case escaped:
+			sb.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				sb.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				sb.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// escapeWord backslash escapes the characters of s that are special to the
+// shell, so that a completed word can be extended further.
+func escapeWord(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(" \t\n'\"\\$`|&;<>()*?[]{}~#!", r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// commonPrefix returns the longest prefix of a and b that doesn't end
+// partway through a character or an escape.
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	for n > 0 && n < len(a) && !utf8.RuneStart(a[n]) {
+		n--
+	}
+	backslashes := 0
+	for i := n - 1; i >= 0 && a[i] == '\\'; i-- {
+		backslashes++
+	}
+	return a[:n-backslashes%2]
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+type CommandIO struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// stdio returns the shell's standard streams, which exec can redirect.
+func (s *Shell) stdio() CommandIO {
+	return CommandIO{Stdin: s.fds.GetFD(0), Stdout: s.fds.GetFD(1), Stderr: s.fds.GetFD(2)}
+}
+
+func (s *Shell) executeList(list *CommandList, cio CommandIO) int {
+	for _, item := range list.Items {
+		if item.Background {
+			s.executeBackground(item.AndOr, cio)
+			s.lastExitCode = 0
+			continue
+		}
+		shell := s.stdio()
+		s.lastExitCode = s.executeAndOr(item.AndOr, cio)
+		if s.flow != flowNone {
+			break
+		}
+		cio = followExec(cio, shell, s.stdio())
+	}
+	return s.lastExitCode
+}
+
+// followExec returns cio with the standard streams that exec redirected
+// from before to after replaced, so that the rest of a list uses them.
+func followExec(cio, before, after CommandIO) CommandIO {
+	if after.Stdin != before.Stdin {
+		cio.Stdin = after.Stdin
+	}
+	if after.Stdout != before.Stdout {
+		cio.Stdout = after.Stdout
+	}
+	if after.Stderr != before.Stderr {
+		cio.Stderr = after.Stderr
+	}
+	return cio
+}
+
+// executeAndOr runs the first pipeline and then each following one whose
+// operator matches the previous status: && after success, || after failure.
+func (s *Shell) executeAndOr(andOr *AndOrList, cio CommandIO) int {
+	status := s.executePipeSequence(andOr.Pipelines[0], cio)
+	for i, op := range andOr.Operators {
+		if s.flow != flowNone {
+			break
+		}
+		if (op == TokenAnd) != (status == 0) {
+			continue
+		}
+		s.lastExitCode = status
+		status = s.executePipeSequence(andOr.Pipelines[i+1], cio)
+	}
+	return status
+}
+
+func (s *Shell) executeBackground(andOr *AndOrList, cio CommandIO) {
+	sub := s.subshell()
+	sub.pgroup = NewProcessGroup()
+	s.lastBackground = sub.pgroup
+	job := s.addJob(sub.pgroup, andOr.String(), true)
+
+	// the job keeps its files open after redirections around it are undone
+	cio, release := sub.detach(cio)
+	direct := s.runsDirectly(andOr)
+	sub.pgroup.Hold()
+	go func() {
+		if direct {
+			sub.pgroup.Finish(sub.executeAndOr(andOr, cio))
+		} else {
+			list := &CommandList{Items: []*ListItem{{AndOr: andOr}}}
+			sub.pgroup.Finish(sub.reexecSubshell(list, cio))
+		}
+		release()
+	}()
+
+	// the job has started once it has a process, so that a script ending
+	// right after it doesn't take the job with it
+	pid := sub.pgroup.FirstPID()
+	if s.interactive() {
+		if pid > 0 {
+			s.Write(cio.Stderr, fmt.Sprintf("[%d] %d\n", job.ID, pid))
+		} else {
+			s.Write(cio.Stderr, fmt.Sprintf("[%d]\n", job.ID))
+		}
+	}
+}
+
+// runsDirectly reports whether a background job is a single external
+// command, which is started as the job's process once its words are
+// expanded. Other jobs run in a subshell process of their own, as the
+// command runs in a forked shell elsewhere, so that each job has a pid
+// as soon as it starts. Substitutions could keep the command from
+// starting for a long time, so they are left to the subshell too.
+func (s *Shell) runsDirectly(andOr *AndOrList) bool {
+	if len(andOr.Pipelines) != 1 || len(andOr.Pipelines[0].Commands) != 1 {
+		return false
+	}
+	cmd, ok := andOr.Pipelines[0].Commands[0].(*SimpleCommand)
+	if !ok || len(cmd.Words) == 0 {
+		return false
+	}
+	name := cmd.Words[0]
+	if name.Raw != name.Literal() || s.functions[name.Raw] != nil || s.builtins[name.Raw] != nil {
+		return false
+	}
+	if _, ok := s.lookPath(name.Raw); !ok {
+		return false
+	}
+	return !strings.ContainsAny(cmd.String(), "`(")
+}
+
+// executePipeSequence runs pipeline, as a job of its own when the shell
+// does job control and isn't already running one.
+func (s *Shell) executePipeSequence(pipeline *PipeSequence, cio CommandIO) int {
+	var status int
+	if s.tty >= 0 && s.pgroup == nil {
+		status = s.executeForegroundJob(pipeline, cio)
+	} else {
+		status = s.runPipeSequence(pipeline, cio)
+	}
+	if pipeline.Negated {
+		if status == 0 {
+			return 1
+		}
+		return 0
+	}
+	return status
+}
+
+func (s *Shell) runPipeSequence(pipeline *PipeSequence, cio CommandIO) int {
+	if len(pipeline.Commands) == 1 {
+		return s.executeNode(pipeline.Commands[0], cio)
+	}
+
+	return s.ExecutePipeline(pipeline, cio)
+}
+
+func (s *Shell) executeNode(node Node, cio CommandIO) int {
+	if s.pgroup != nil && s.subshellLevel > 0 {
+		if sig := s.pgroup.Killed(); sig != 0 {
+			s.flow = flowExit
+			return 128 + int(sig)
+		}
+	}
+	procSubs := len(s.procSubs)
+	defer s.closeProcSubs(procSubs)
+	streams := s.streams
+	s.streams = cio
+	defer func() { s.streams = streams }()
+
+	switch n := node.(type) {
+	case *SimpleCommand:
+		return s.executeSimpleCommand(n, cio)
+	case *CompoundCommand:
+		cio, undo, err := s.handleRedirections(n.Redirections, cio)
+		defer undo()
+		if err != nil {
+			s.Write(cio.Stderr, err.Error()+"\n")
+			return 1
+		}
+		return s.executeNode(n.Body, cio)
+	case *CommandList:
+		return s.executeList(n, cio)
+	case *ArithCommand:
+		return s.executeArith(n, cio)
+	case *IfClause:
+		return s.executeIf(n, cio)
+	case *Subshell:
+		return s.executeSubshell(n.Body, cio)
+	case *BraceGroup:
+		return s.executeList(n.Body, cio)
+	case *FunctionDef:
+		s.functions[n.Name] = n
+		return 0
+	case *CaseClause:
+		return s.executeCase(n, cio)
+	case *ForClause:
+		return s.executeFor(n, cio)
+	case *ArithForClause:
+		return s.executeArithFor(n, cio)
+	case *WhileClause:
+		return s.executeWhile(n, cio)
+	default:
+		s.Write(cio.Stderr, fmt.Sprintf("cannot execute %T\n", node))
+		return 1
+	}
+}
+
+// closeProcSubs closes the process substitutions opened after the first n,
+// once the command that used them has finished.
+func (s *Shell) closeProcSubs(n int) {
+	for _, fd := range s.procSubs[n:] {
+		s.fds.CloseFD(fd)
+	}
+	s.procSubs = s.procSubs[:n]
+}
+
+func (s *Shell) executeSimpleCommand(cmd *SimpleCommand, cio CommandIO) int {
+	s.substituted = false
+	args, err := s.expandWords(cmd.Words)
+	if err != nil {
+		s.Write(cio.Stderr, err.Error()+"\n")
+		return 1
+	}
+
+	// exec without a command applies its redirections to the shell itself
+	permanent := len(args) == 1 && args[0] == "exec"
+	cio, undo, err := s.applyRedirections(cmd.Redirections, cio, permanent)
+	defer undo()
+	if err != nil {
+		s.Write(cio.Stderr, err.Error()+"\n")
+		return 1
+	}
+
+	restore, err := s.assign(cmd.Assignments, len(args) > 0)
+	defer restore()
+	if err != nil {
+		s.Write(cio.Stderr, err.Error()+"\n")
+		return 1
+	}
+
+	if len(args) == 0 {
+		// with no command name the status is that of the last command
+		// substitution, if any
+		if s.substituted {
+			return s.lastExitCode
+		}
+		return 0
+	}
+
+	if fn, ok := s.functions[args[0]]; ok {
+		return s.callFunction(fn, args[1:], cio)
+	}
+	if builtin, ok := s.builtins[args[0]]; ok {
+		return builtin(s, args[1:], cio)
+	}
+	return s.runExternal(args, cio)
+}
+
+// splitAssignment splits a NAME=value word into the name and the word
+// holding the value.
+func splitAssignment(w *Word) (string, *Word) {
+	name, rest, _ := strings.Cut(w.Parts[0].Text, "=")
+	value := &Word{Raw: w.Raw[len(name)+1:]}
+	if rest != "" {
+		value.Parts = append(value.Parts, WordPart{Text: rest, Quote: Unquoted})
+	}
+	value.Parts = append(value.Parts, w.Parts[1:]...)
+	return name, value
+}
+
+// assign expands and makes the NAME=value assignments in words from left
+// to right, so that each sees the ones before it. Temporary assignments,
+// made for a single command, are exported, and the returned function puts
+// the previous values back.
+func (s *Shell) assign(words []*Word, temporary bool) (func(), error) {
+	previous := make(map[string]savedVar, len(words))
+	restore := func() {
+		for name, old := range previous {
+			s.restoreVar(name, old)
+		}
+	}
+	for _, w := range words {
+		name, valueWord := splitAssignment(w)
+		value, err := s.expandString(s.expandTilde(valueWord, true))
+		if err != nil {
+			return restore, err
+		}
+		if temporary {
+			if _, ok := previous[name]; !ok {
+				previous[name] = s.saveVar(name)
+			}
+			s.exportVar(name)
+		}
+		s.setVar(name, value)
+	}
+	return restore, nil
+}
+
+// maxFuncDepth limits how deeply function calls can nest.
+const maxFuncDepth = 1000
+
+// callFunction runs the body of fn with args as the positional parameters
+// and a new scope for local variables. Loops outside the function cannot
+// be left with break or continue from inside it.
+func (s *Shell) callFunction(fn *FunctionDef, args []string, cio CommandIO) int {
+	if s.funcDepth >= maxFuncDepth {
+		s.Write(cio.Stderr, fmt.Sprintf("%s: maximum function nesting level exceeded (%d)\n", fn.Name, maxFuncDepth))
+		return 1
+	}
+
+	positional, loopDepth := s.positional, s.loopDepth
+	s.positional = slices.Clone(args)
+	s.loopDepth = 0
+	s.funcDepth++
+	s.locals = append(s.locals, make(map[string]savedVar))
+	defer func() {
+		frame := s.locals[len(s.locals)-1]
+		s.locals = s.locals[:len(s.locals)-1]
+		for name, old := range frame {
+			s.restoreVar(name, old)
+		}
+		s.funcDepth--
+		s.positional, s.loopDepth = positional, loopDepth
+	}()
+
+	status := s.executeNode(fn.Body, cio)
+	if s.flow == flowReturn {
+		s.flow = flowNone
+	}
+	return status
+}
+
+func (s *Shell) executeIf(clause *IfClause, cio CommandIO) int {
+	for i, condition := range clause.Conditions {
+		if s.executeList(condition, cio) == 0 {
+			return s.executeList(clause.Bodies[i], cio)
+		}
+	}
+	if clause.Else != nil {
+		return s.executeList(clause.Else, cio)
+	}
+	return 0
+}
+
+// executeCase runs the body of the first item with a pattern matching the
+// word. An item ended by ;& falls through to the next body, and one ended
+// by ;;& goes on testing the following items.
+func (s *Shell) executeCase(clause *CaseClause, cio CommandIO) int {
+	word, err := s.expandString(s.expandTilde(clause.Word, false))
+	if err != nil {
+		s.Write(cio.Stderr, err.Error()+"\n")
+		return 1
+	}
+	run := func(body *CommandList) int {
+		if len(body.Items) == 0 {
+			return 0
+		}
+		return s.executeList(body, cio)
+	}
+
+	status := 0
+	for i := 0; i < len(clause.Items); i++ {
+		item := clause.Items[i]
+		matched, err := s.caseMatch(word, item.Patterns)
+		if err != nil {
+			s.Write(cio.Stderr, err.Error()+"\n")
+			return 1
+		}
+		if !matched {
+			continue
+		}
+
+		status = run(item.Body)
+		for item.Terminator == TokenSemicolonAnd && i+1 < len(clause.Items) && s.flow == flowNone {
+			i++
+			item = clause.Items[i]
+			status = run(item.Body)
+		}
+		if item.Terminator != TokenDoubleSemicolonAnd || s.flow != flowNone {
+			break
+		}
+	}
+	return status
+}
+
+// caseMatch reports whether word matches any of the patterns, which are
+// expanded one at a time until one matches.
+func (s *Shell) caseMatch(word string, patterns []*Word) (bool, error) {
+	for _, p := range patterns {
+		pattern, err := s.expandPattern(p)
+		if err != nil {
+			return false, err
+		}
+		if matchRunes([]rune(pattern), []rune(word), s.shopts["extglob"]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// endIteration consumes a pending break or continue aimed at the loop
+// being executed and reports whether the loop has to stop. One that
+// targets an outer loop stops this one and is left pending.
+func (s *Shell) endIteration() bool {
+	switch s.flow {
+	case flowNone:
+		return false
+	case flowReturn, flowExit, flowInterrupt:
+		return true
+	}
+	if s.flowLevels > 1 {
+		s.flowLevels--
+		return true
+	}
+	kind := s.flow
+	s.flow = flowNone
+	return kind == flowBreak
+}
+
+func (s *Shell) executeFor(loop *ForClause, cio CommandIO) int {
+	items := slices.Clone(s.positional)
+	if loop.Words != nil {
+		var err error
+		if items, err = s.expandWords(loop.Words); err != nil {
+			s.Write(cio.Stderr, err.Error()+"\n")
+			return 1
+		}
+	}
+
+	s.loopDepth++
+	defer func() { s.loopDepth-- }()
+
+	status := 0
+	for _, item := range items {
+		s.setVar(loop.Name, item)
+		status = s.executeList(loop.Body, cio)
+		if s.endIteration() {
+			break
+		}
+	}
+	return status
+}
+
+func (s *Shell) executeArithFor(loop *ArithForClause, cio CommandIO) int {
+	eval := func(expr string) (int64, bool) {
+		if expr == "" {
+			return 1, true
+		}
+		n, err := s.arithmetic(expr)
+		if err != nil {
+			s.Write(cio.Stderr, err.Error()+"\n")
+			return 0, false
+		}
+		return n, true
+	}
+
+	s.loopDepth++
+	defer func() { s.loopDepth-- }()
+
+	if _, ok := eval(loop.Init); !ok {
+		return 1
+	}
+	status := 0
+	for {
+		n, ok := eval(loop.Condition)
+		if !ok {
+			return 1
+		}
+		if n == 0 {
+			break
+		}
+		status = s.executeList(loop.Body, cio)
+		if s.endIteration() {
+			break
+		}
+		if _, ok := eval(loop.Update); !ok {
+			return 1
+		}
+	}
+	return status
+}
+
+// executeWhile runs a while or until loop. A break or continue in the
+// condition applies to the loop as it would in the body.
+func (s *Shell) executeWhile(loop *WhileClause, cio CommandIO) int {
+	s.loopDepth++
+	defer func() { s.loopDepth-- }()
+
+	status := 0
+	for {
+		condition := s.executeList(loop.Condition, cio)
+		if s.flow != flowNone {
+			if s.endIteration() {
+				break
+			}
+			continue
+		}
+		if (condition == 0) == loop.Until {
+			break
+		}
+		status = s.executeList(loop.Body, cio)
+		if s.endIteration() {
+			break
+		}
+	}
+	return status
+}
+
+// executeArith evaluates ((expr)), which succeeds when the result is
+// non-zero.
+func (s *Shell) executeArith(cmd *ArithCommand, cio CommandIO) int {
+	n, err := s.arithmetic(cmd.Expr)
+	if err != nil {
+		s.Write(cio.Stderr, err.Error()+"\n")
+		return 1
+	}
+	if n == 0 {
+		return 1
+	}
+	return 0
+}
+
+func (s *Shell) lookPath(name string) (string, bool) {
+	if strings.Contains(name, "/") {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.workingDir, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "", false
+		}
+		return path, true
+	}
+	pathList, _ := s.getVar("PATH")
+	return findInPath(name, pathList)
+}
+
+// environ returns the environment passed to child processes, with extra
+// applied on top of the shell's variables.
+func (s *Shell) environ(extra map[string]string) []string {
+	env := make([]string, 0, len(s.exported)+len(extra))
+	for name := range s.exported {
+		if _, ok := extra[name]; ok {
+			continue
+		}
+		if value, ok := s.getVar(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	for name, value := range extra {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+func (s *Shell) runExternal(args []string, cio CommandIO) int {
+	path, ok := s.lookPath(args[0])
+	if !ok {
+		s.Write(cio.Stderr, fmt.Sprintf("%s: command not found\n", args[0]))
+		return 127
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Stdin = cio.Stdin
+	cmd.Stdout = cio.Stdout
+	cmd.Stderr = cio.Stderr
+	cmd.ExtraFiles = s.fds.ExtraFiles()
+	cmd.Env = s.environ(nil)
+	cmd.Dir = s.workingDir
+	return s.runProcess(args[0], cmd)
+}
+
+// runProcess starts cmd and waits for it to finish. Inside a job it joins
+// the job's process group and returns 128 plus the signal if it stops.
+func (s *Shell) runProcess(name string, cmd *exec.Cmd) int {
+	if s.pgroup != nil {
+		p, err := s.pgroup.Start(cmd, s.tty)
+		if err != nil {
+			s.Write(cmd.Stderr, fmt.Sprintf("%s: %v\n", name, err))
+			return 126
+		}
+		status := s.pgroup.Wait(p)
+		if status == 128+int(syscall.SIGINT) && s.pgroup.Foreground() {
+			s.flow = flowInterrupt
+		}
+		return status
+	}
+
+	if err := cmd.Start(); err != nil {
+		s.Write(cmd.Stderr, fmt.Sprintf("%s: %v\n", name, err))
+		return 126
+	}
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitStatus(exitErr.ProcessState)
+		}
+		s.Write(cmd.Stderr, fmt.Sprintf("%s: %v\n", name, err))
+		return 126
+	}
+	return 0
+}
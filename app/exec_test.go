@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for the shell, which runs some
+// subshells by executing itself with -c.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "-c" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// runScript runs script in a shell working in dir and returns its status.
+func runScript(t *testing.T, dir, script string) int {
+	t.Helper()
+	s, err := NewScriptShell(newReaderSource(strings.NewReader(script)), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.workingDir = dir
+	return s.RunScript()
+}
+
+// TestBackgroundJobKeepsRedirection checks that a background job started
+// inside a redirection still writes to it after the redirection is undone.
+func TestBackgroundJobKeepsRedirection(t *testing.T) {
+	scripts := map[string]string{
+		"group":    "f() { sleep 0.2; echo late; }; { f & } > out; wait",
+		"loop":     "for i in 1; do { sleep 0.2; echo late; } & done > out; wait",
+		"external": "{ sh -c 'sleep 0.2; echo late' & } > out; wait",
+	}
+	for name, script := range scripts {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if status := runScript(t, dir, script); status != 0 {
+				t.Fatalf("status %d", status)
+			}
+			out, err := os.ReadFile(filepath.Join(dir, "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != "late\n" {
+				t.Errorf("out holds %q, want %q", out, "late\n")
+			}
+		})
+	}
+}
+
+// TestBackgroundJobSeesStatus checks that $? in a background job is the
+// status of the command before it, in a process of its own or not.
+func TestBackgroundJobSeesStatus(t *testing.T) {
+	dir := t.TempDir()
+	script := "false; { echo $?; } > out & wait; f() { return 3; }; f; (echo $?) >> out & wait; true; { echo $?; } >> out & wait"
+	if status := runScript(t, dir, script); status != 0 {
+		t.Fatalf("status %d", status)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1\n3\n0\n"; string(out) != want {
+		t.Errorf("out holds %q, want %q", out, want)
+	}
+}
+
+// TestBackgroundJobOutlivesScript checks that a job started last in a -c
+// script runs after the shell has exited.
+func TestBackgroundJobOutlivesScript(t *testing.T) {
+	scripts := map[string]string{
+		"builtin":  "echo late > out &",
+		"external": "/bin/echo late > out &",
+	}
+	for name, script := range scripts {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cmd := exec.Command(os.Args[0], "-c", script)
+			cmd.Dir = dir
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if out, err := os.ReadFile(filepath.Join(dir, "out")); err == nil && string(out) == "late\n" {
+					return
+				}
+			}
+			t.Error("the job never wrote to out")
+		})
+	}
+}
+
+// TestBuiltinStopsOnBrokenPipe checks that a loop of builtins writing into
+// a pipeline ends once the reader has gone.
+func TestBuiltinStopsOnBrokenPipe(t *testing.T) {
+	done := make(chan int)
+	go func() {
+		done <- runScript(t, t.TempDir(), "while :; do echo y; done | head -1 > /dev/null")
+	}()
+	select {
+	case status := <-done:
+		if status != 0 {
+			t.Errorf("status %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop kept writing to a closed pipe")
+	}
+}
+
+// TestNegatedPipeline checks that ! inverts the status of the pipeline
+// after it and that a quoted ! is a command name.
+func TestNegatedPipeline(t *testing.T) {
+	dir := t.TempDir()
+	script := "! false; echo $? > out; ! true; echo $? >> out; ! echo a | grep -q a || echo neg >> out; ! ! false; echo $? >> out; '!' 2> /dev/null; echo $? >> out"
+	if status := runScript(t, dir, script); status != 0 {
+		t.Fatalf("status %d", status)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0\n1\nneg\n1\n127\n"; string(out) != want {
+		t.Errorf("out holds %q, want %q", out, want)
+	}
+}
+
+// TestAssignmentsInOrder checks that each assignment before a command, or
+// on its own, sees the ones to its left.
+func TestAssignmentsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	script := "x=1 y=$x; echo $y > out; unset x y; x=2 y=$x env | grep '^[xy]=' | sort >> out; echo \"[$x$y]\" >> out"
+	if status := runScript(t, dir, script); status != 0 {
+		t.Fatalf("status %d", status)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1\nx=2\ny=2\n[]\n"; string(out) != want {
+		t.Errorf("out holds %q, want %q", out, want)
+	}
+}
+
+// TestUnsetParameterErrorEndsScript checks that ${name:?word} ends a
+// non-interactive shell, but only a subshell it occurs in.
+func TestUnsetParameterErrorEndsScript(t *testing.T) {
+	dir := t.TempDir()
+	script := "(: ${x:?}; echo in > out) 2> /dev/null; echo out >> out; : ${x:?unset} 2> /dev/null; echo after >> out"
+	if status := runScript(t, dir, script); status == 0 {
+		t.Error("status 0")
+	}
+	out, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "out\n"; string(out) != want {
+		t.Errorf("out holds %q, want %q", out, want)
+	}
+}
+
+// TestCasePatternFromVariable checks that a case pattern matches with the
+// glob characters of an unquoted variable and literally with those of a
+// quoted one.
+func TestCasePatternFromVariable(t *testing.T) {
+	tests := []struct {
+		word, pattern string
+		want          bool
+	}{
+		{"abc", "$x", true},
+		{"abc", "\"$x\"", false},
+		{"*", "\"$x\"", true},
+		{"abc", "a$x", true},
+		{"a.c", "$b", true},
+		{"abc", "'$x'", false},
+		{"abc", "${x}c", true},
+	}
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setVar("x", "*")
+	s.setVar("b", "a[.]?")
+	for _, test := range tests {
+		got, err := s.caseMatch(test.word, []*Word{parseWord(t, s, test.pattern)})
+		if err != nil || got != test.want {
+			t.Errorf("%s matching %s = %v, %v; want %v", test.word, test.pattern, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,1133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrBadSubstitution = errors.New("bad substitution")
+
+// expander turns a word into fields. Parameter expansions in unquoted
+// context are split on IFS; quoted text is never split and quotes are
+// removed.
+type expander struct {
+	s      *Shell
+	fields []string
+	cur    strings.Builder
+	// patterns holds each field as a shell pattern, with the characters
+	// that came from quoted text escaped.
+	patterns []string
+	pat      strings.Builder
+	// started is set once the current field exists, even if it is empty
+	// as for "".
+	started bool
+	// noSplit disables field splitting, as for assignment values.
+	noSplit bool
+	// splitLiterals makes unquoted literal text subject to field
+	// splitting, as it is in the operand of ${VAR:-word}.
+	splitLiterals bool
+}
+
+func (s *Shell) expandWords(words []*Word) ([]string, error) {
+	var fields []string
+	for _, word := range words {
+		for _, w := range expandBraces(word) {
+			expanded, err := s.expandWord(w)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, expanded...)
+		}
+	}
+	return fields, nil
+}
+
+func (s *Shell) expandWord(w *Word) ([]string, error) {
+	e := &expander{s: s}
+	if err := e.expandParts(s.expandTilde(w, isAssignment(w)).Parts); err != nil {
+		return nil, err
+	}
+	return s.expandPathnames(e.finish(), e.patterns)
+}
+
+// expandTilde replaces the tilde prefixes of w with the directories they
+// name, as quoted text. A prefix runs from an unquoted ~ at the start of
+// the word up to the first unquoted slash; with assignment set prefixes
+// may also follow the first = and every unquoted colon, and end at a colon.
+func (s *Shell) expandTilde(w *Word, assignment bool) *Word {
+	if !strings.Contains(w.Raw, "~") {
+		return w
+	}
+
+	out := &Word{Raw: w.Raw}
+	add := func(text string, quote QuoteKind) {
+		if text != "" {
+			out.addPart(text, quote)
+		}
+	}
+	eligible, seenEquals := true, false
+	for n, part := range w.Parts {
+		if part.Quote != Unquoted {
+			out.addPart(part.Text, part.Quote)
+			eligible = false
+			continue
+		}
+
+		text := part.Text
+		start := 0
+		for i := 0; i < len(text); i++ {
+			if eligible && text[i] == '~' {
+				end := i + 1
+				for end < len(text) && text[end] != '/' && !(assignment && text[end] == ':') {
+					end++
+				}
+				// a prefix that runs into quoted text is not expanded
+				if end < len(text) || n == len(w.Parts)-1 {
+					if dir, ok := s.tildeDir(text[i+1 : end]); ok {
+						add(text[start:i], Unquoted)
+						out.addPart(dir, SingleQuoted)
+						start, i = end, end-1
+						eligible = false
+						continue
+					}
+				}
+			}
+
+			eligible = false
+			switch {
+			case assignment && text[i] == ':':
+				eligible = true
+			case assignment && text[i] == '=' && !seenEquals:
+				eligible, seenEquals = true, true
+			case text[i] == '`':
+				if end := closingBacktick(text[i:]); end > 0 {
+					i += end
+				}
+			case text[i] == '$' && i+1 < len(text) && (text[i+1] == '{' || text[i+1] == '('):
+				if end := matchingClose(text, i+1); end > 0 {
+					i = end
+				}
+			}
+		}
+		add(text[start:], Unquoted)
+	}
+	return out
+}
+
+// tildeDir returns the directory named by the tilde prefix ~name: the
+// home directory for an empty name, $PWD for + and $OLDPWD for -, or the
+// home directory of the named user.
+func (s *Shell) tildeDir(name string) (string, bool) {
+	switch name {
+	case "":
+		if home, ok := s.getVar("HOME"); ok {
+			return home, true
+		}
+		u, err := user.Current()
+		if err != nil {
+			return "", false
+		}
+		return u.HomeDir, true
+	case "+":
+		return s.getVar("PWD")
+	case "-":
+		return s.getVar("OLDPWD")
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", false
+	}
+	return u.HomeDir, true
+}
+
+// expandString expands w to a single string without field splitting, as
+// for assignment values.
+func (s *Shell) expandString(w *Word) (string, error) {
+	e := &expander{s: s, noSplit: true}
+	if err := e.expandParts(w.Parts); err != nil {
+		return "", err
+	}
+	return strings.Join(e.finish(), " "), nil
+}
+
+// expandHereDoc expands the body of a here-document with an unquoted
+// delimiter. Expansions are performed as inside double quotes, but quotes
+// are literal and a backslash only escapes $, `, \ and a newline.
+func (s *Shell) expandHereDoc(body string) (string, error) {
+	w := &Word{}
+	start := 0
+	for i := 0; i+1 < len(body); i++ {
+		if body[i] != '\\' {
+			continue
+		}
+		switch next := body[i+1]; next {
+		case '$', '`', '\\', '\n':
+			w.addPart(body[start:i], DoubleQuoted)
+			if next != '\n' {
+				w.addPart(body[i+1:i+2], SingleQuoted)
+			}
+			i++
+			start = i + 1
+		}
+	}
+	w.addPart(body[start:], DoubleQuoted)
+	return s.expandString(w)
+}
+
+// expandPattern expands w without field splitting into a pattern in which
+// quoted characters match literally, as for case patterns.
+func (s *Shell) expandPattern(w *Word) (string, error) {
+	e := &expander{s: s, noSplit: true}
+	if err := e.expandParts(s.expandTilde(w, false).Parts); err != nil {
+		return "", err
+	}
+	e.finish()
+	return strings.Join(e.patterns, " "), nil
+}
+
+func (e *expander) expandParts(parts []WordPart) error {
+	for _, part := range parts {
+		switch part.Quote {
+		case SingleQuoted:
+			e.write(part.Text, true)
+		case DoubleQuoted:
+			if part.Text == "" {
+				e.started = true
+			}
+			if err := e.expandText(part.Text, true); err != nil {
+				return err
+			}
+		default:
+			if err := e.expandText(part.Text, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *expander) expandText(text string, quoted bool) error {
+	for i := 0; i < len(text); {
+		if text[i] == '$' {
+			next, err := e.expandDollar(text, i, quoted)
+			if err != nil {
+				return err
+			}
+			i = next
+			continue
+		}
+		if text[i] == '`' {
+			end := closingBacktick(text[i:])
+			if end < 0 {
+				return fmt.Errorf("unexpected EOF while looking for matching ``'")
+			}
+			if err := e.substitute(unescapeBackticks(text[i+1:i+end]), quoted); err != nil {
+				return err
+			}
+			i += end + 1
+			continue
+		}
+
+		if !quoted && (text[i] == '<' || text[i] == '>') && i+1 < len(text) && text[i+1] == '(' {
+			end := matchingClose(text[i:], 1)
+			if end < 0 {
+				return fmt.Errorf("unexpected EOF while looking for matching `)'")
+			}
+			path, err := e.s.processSubstitution(text[i+2:i+end], text[i] == '>')
+			if err != nil {
+				return err
+			}
+			e.write(path, true)
+			i += end + 1
+			continue
+		}
+
+		j := i + 1
+		for j < len(text) && text[j] != '$' && text[j] != '`' && (quoted || (text[j] != '<' && text[j] != '>')) {
+			j++
+		}
+		if e.splitLiterals && !quoted {
+			e.writeSplit(text[i:j])
+		} else {
+			e.write(text[i:j], quoted)
+		}
+		i = j
+	}
+	return nil
+}
+
+// expandDollar expands the expression starting with the $ at text[i] and
+// returns the index just past it.
+func (e *expander) expandDollar(text string, i int, quoted bool) (int, error) {
+	if i+1 >= len(text) {
+		e.write("$", quoted)
+		return i + 1, nil
+	}
+
+	c := text[i+1]
+	switch {
+	case c == '{':
+		end := matchingClose(text, i+1)
+		if end < 0 {
+			return 0, ErrBadSubstitution
+		}
+		return end + 1, e.expandBraced(text[i+2:end], quoted)
+
+	case c == '(' && i+2 < len(text) && text[i+2] == '(':
+		end := matchingClose(text, i+1)
+		if end > 0 && matchingClose(text, i+2) == end-1 {
+			n, err := e.s.arithmetic(text[i+3 : end-1])
+			if err != nil {
+				return 0, err
+			}
+			e.writeValue(strconv.FormatInt(n, 10), quoted)
+			return end + 1, nil
+		}
+		fallthrough
+
+	case c == '(':
+		end := matchingClose(text, i+1)
+		if end < 0 {
+			return 0, fmt.Errorf("unexpected EOF while looking for matching `)'")
+		}
+		return end + 1, e.substitute(text[i+2:end], quoted)
+
+	case c == '@' || c == '*':
+		e.writePositional(c, quoted)
+		return i + 2, nil
+
+	case strings.IndexByte("?$!#-0123456789", c) >= 0:
+		value, _ := e.s.lookupParam(text[i+1 : i+2])
+		e.writeValue(value, quoted)
+		return i + 2, nil
+
+	case isNameStart(c):
+		j := i + 2
+		for j < len(text) && isNameChar(text[j]) {
+			j++
+		}
+		value, _ := e.s.getVar(text[i+1 : j])
+		e.writeValue(value, quoted)
+		return j, nil
+	}
+
+	e.write("$", quoted)
+	return i + 1, nil
+}
+
+// expandBraced expands the contents of ${...}, including the POSIX
+// operators and the bash pattern substitution, case conversion and
+// substring forms.
+func (e *expander) expandBraced(expr string, quoted bool) error {
+	if len(expr) > 1 && expr[0] == '#' {
+		name := expr[1:]
+		if name == "@" || name == "*" {
+			e.writeValue(strconv.Itoa(len(e.s.positional)), quoted)
+			return nil
+		}
+		if !isParamName(name) {
+			return fmt.Errorf("${%s}: %w", expr, ErrBadSubstitution)
+		}
+		value, _ := e.s.lookupParam(name)
+		e.writeValue(strconv.Itoa(utf8.RuneCountInString(value)), quoted)
+		return nil
+	}
+
+	name := paramNameAt(expr)
+	if name == "" {
+		return fmt.Errorf("${%s}: %w", expr, ErrBadSubstitution)
+	}
+	op := expr[len(name):]
+
+	isList := name == "@" || name == "*"
+	var values []string
+	set := true
+	if isList {
+		values = e.s.positional
+		set = len(values) > 0
+	} else {
+		value, ok := e.s.lookupParam(name)
+		values = []string{value}
+		set = ok
+	}
+
+	write := func(values []string) {
+		if isList {
+			e.writeList(name[0], values, quoted)
+		} else {
+			e.writeValue(values[0], quoted)
+		}
+	}
+	transform := func(f func(string) string) {
+		out := make([]string, len(values))
+		for i, v := range values {
+			out[i] = f(v)
+		}
+		write(out)
+	}
+
+	if op == "" {
+		write(values)
+		return nil
+	}
+
+	switch {
+	case strings.IndexByte("-=?+", op[0]) >= 0 || (len(op) > 1 && op[0] == ':' && strings.IndexByte("-=?+", op[1]) >= 0):
+		empty := !set
+		if op[0] == ':' {
+			op = op[1:]
+			empty = empty || strings.Join(values, "") == ""
+		}
+		word := op[1:]
+
+		switch op[0] {
+		case '-':
+			if empty {
+				return e.expandOperand(word, quoted)
+			}
+		case '=':
+			if empty {
+				if !isName(name) {
+					return fmt.Errorf("$%s: cannot assign in this way", name)
+				}
+				value, err := e.operandString(word, quoted)
+				if err != nil {
+					return err
+				}
+				e.s.setVar(name, value)
+				e.writeValue(value, quoted)
+				return nil
+			}
+		case '?':
+			if empty {
+				msg, err := e.operandString(word, quoted)
+				if err != nil {
+					return err
+				}
+				if msg == "" {
+					msg = "parameter null or not set"
+				}
+				// the error ends a shell that isn't interactive
+				if !e.s.interactive() {
+					e.s.flow = flowExit
+				}
+				return fmt.Errorf("%s: %s", name, msg)
+			}
+		case '+':
+			if empty {
+				e.write("", quoted)
+				return nil
+			}
+			return e.expandOperand(word, quoted)
+		}
+		write(values)
+
+	case op[0] == '#' || op[0] == '%':
+		longest := len(op) > 1 && op[1] == op[0]
+		word := op[1:]
+		if longest {
+			word = op[2:]
+		}
+		pattern, err := e.operandPattern(word)
+		if err != nil {
+			return err
+		}
+		if op[0] == '#' {
+			transform(func(v string) string { return trimPrefixPattern(v, pattern, longest) })
+		} else {
+			transform(func(v string) string { return trimSuffixPattern(v, pattern, longest) })
+		}
+
+	case op[0] == '/':
+		var mode byte
+		rest := op[1:]
+		if rest != "" && strings.IndexByte("/#%", rest[0]) >= 0 {
+			mode = rest[0]
+			rest = rest[1:]
+		}
+		patternWord, repWord, _ := cutUnquoted(rest, '/')
+		pattern, err := e.operandPattern(patternWord)
+		if err != nil {
+			return err
+		}
+		rep, err := e.operandString(repWord, quoted)
+		if err != nil {
+			return err
+		}
+		transform(func(v string) string { return replacePattern(v, pattern, rep, mode) })
+
+	case op[0] == '^' || op[0] == ',':
+		all := len(op) > 1 && op[1] == op[0]
+		word := op[1:]
+		if all {
+			word = op[2:]
+		}
+		pattern, err := e.operandPattern(word)
+		if err != nil {
+			return err
+		}
+		if pattern == "" {
+			pattern = "?"
+		}
+		convert := unicode.ToUpper
+		if op[0] == ',' {
+			convert = unicode.ToLower
+		}
+		transform(func(v string) string { return convertCase(v, pattern, convert, all) })
+
+	case op[0] == ':':
+		offsetExpr, lengthExpr, hasLength := strings.Cut(op[1:], ":")
+		offset, err := e.s.evalIndex(offsetExpr)
+		if err != nil {
+			return err
+		}
+		length := -1
+		if hasLength {
+			if length, err = e.s.evalIndex(lengthExpr); err != nil {
+				return err
+			}
+		}
+
+		if isList {
+			params := append([]string{e.s.scriptName}, e.s.positional...)
+			start, end, ok := sliceBounds(len(params), offset, length, hasLength)
+			if !ok {
+				return fmt.Errorf("%s: substring expression < 0", lengthExpr)
+			}
+			write(params[start:end])
+			return nil
+		}
+
+		runes := []rune(values[0])
+		start, end, ok := sliceBounds(len(runes), offset, length, hasLength)
+		if !ok {
+			return fmt.Errorf("%s: substring expression < 0", lengthExpr)
+		}
+		e.writeValue(string(runes[start:end]), quoted)
+
+	default:
+		return fmt.Errorf("${%s}: %w", expr, ErrBadSubstitution)
+	}
+	return nil
+}
+
+// paramNameAt returns the parameter name at the start of expr.
+func paramNameAt(expr string) string {
+	if expr == "" {
+		return ""
+	}
+	if strings.IndexByte("@*#?$!-", expr[0]) >= 0 {
+		return expr[:1]
+	}
+	end := 0
+	if isAllDigits(expr[:1]) {
+		for end < len(expr) && expr[end] >= '0' && expr[end] <= '9' {
+			end++
+		}
+		return expr[:end]
+	}
+	for end < len(expr) && isNameChar(expr[end]) {
+		end++
+	}
+	if end == 0 || !isNameStart(expr[0]) {
+		return ""
+	}
+	return expr[:end]
+}
+
+// isParamName reports whether name can follow $ inside braces: a variable
+// name, a positional parameter number or a special parameter.
+func isParamName(name string) bool {
+	if len(name) == 1 && strings.IndexByte("?$!#-0", name[0]) >= 0 {
+		return true
+	}
+	return isName(name) || isAllDigits(name)
+}
+
+// evalIndex evaluates an offset or length of a substring expansion.
+func (s *Shell) evalIndex(expr string) (int, error) {
+	n, err := s.arithmetic(expr)
+	return int(n), err
+}
+
+// sliceBounds resolves the offset and length of a substring expansion on a
+// sequence of n elements, where negative values count from the end.
+func sliceBounds(n, offset, length int, hasLength bool) (int, int, bool) {
+	if offset < 0 {
+		offset += n
+	}
+	if offset < 0 || offset > n {
+		return 0, 0, true
+	}
+	end := n
+	if hasLength {
+		if length < 0 {
+			end = n + length
+			if end < offset {
+				return 0, 0, false
+			}
+		} else {
+			end = min(offset+length, n)
+		}
+	}
+	return offset, end, true
+}
+
+// expandOperand expands the word of ${VAR:-word} and similar operators in
+// place, keeping its own quoting.
+func (e *expander) expandOperand(word string, quoted bool) error {
+	splitLiterals := e.splitLiterals
+	e.splitLiterals = true
+	defer func() { e.splitLiterals = splitLiterals }()
+
+	for _, part := range operandParts(word, quoted) {
+		switch part.Quote {
+		case SingleQuoted:
+			e.write(part.Text, true)
+		case DoubleQuoted:
+			if part.Text == "" {
+				e.write("", true)
+			}
+			if err := e.expandText(part.Text, true); err != nil {
+				return err
+			}
+		default:
+			if err := e.expandText(part.Text, quoted); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *expander) operandString(word string, quoted bool) (string, error) {
+	sub := &expander{s: e.s, noSplit: true}
+	if err := sub.expandOperand(word, quoted); err != nil {
+		return "", err
+	}
+	return strings.Join(sub.finish(), " "), nil
+}
+
+// operandPattern expands word into a pattern in which quoted characters
+// match literally. Double quotes around the whole expansion don't quote
+// the pattern, so it is read as though they weren't there.
+func (e *expander) operandPattern(word string) (string, error) {
+	sub := &expander{s: e.s, noSplit: true}
+	if err := sub.expandOperand(word, false); err != nil {
+		return "", err
+	}
+	sub.finish()
+	return strings.Join(sub.patterns, " "), nil
+}
+
+// operandParts splits the source of an operator's word into quoted parts.
+// Inside double quotes single quotes are literal and unquoted text is
+// recorded as double-quoted.
+func operandParts(text string, inDouble bool) []WordPart {
+	w := &Word{}
+	plain := Unquoted
+	if inDouble {
+		plain = DoubleQuoted
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			r, size := utf8.DecodeRuneInString(text[i+1:])
+			if inDouble && !strings.ContainsRune("$`\"\\\n", r) {
+				w.addPart("\\", plain)
+				i++
+				continue
+			}
+			w.addPart(string(r), SingleQuoted)
+			i += 1 + size
+
+		case c == '\'' && !inDouble:
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 {
+				end = len(text) - i - 1
+			}
+			w.addPart(text[i+1:i+1+end], SingleQuoted)
+			i += end + 2
+
+		case c == '"':
+			end := i + 1
+			for end < len(text) && text[end] != '"' {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			w.addPart("", DoubleQuoted)
+			for _, part := range operandParts(text[i+1:min(end, len(text))], true) {
+				w.addPart(part.Text, part.Quote)
+			}
+			i = end + 1
+
+		case c == '$' && i+1 < len(text) && (text[i+1] == '{' || text[i+1] == '('):
+			end := matchingClose(text, i+1)
+			if end < 0 {
+				end = len(text) - 1
+			}
+			w.addPart(text[i:end+1], plain)
+			i = end + 1
+
+		case c == '`':
+			end := closingBacktick(text[i:])
+			if end < 0 {
+				end = len(text) - i - 1
+			}
+			w.addPart(text[i:i+end+1], plain)
+			i += end + 1
+
+		default:
+			w.addPart(text[i:i+1], plain)
+			i++
+		}
+	}
+	return w.Parts
+}
+
+// cutUnquoted splits text around the first sep that is not quoted,
+// escaped or inside a nested ${...}.
+func cutUnquoted(text string, sep byte) (string, string, bool) {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '\'':
+			if end := strings.IndexByte(text[i+1:], '\''); end >= 0 {
+				i += end + 1
+			}
+		case '"':
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case '$':
+			if i+1 < len(text) && (text[i+1] == '{' || text[i+1] == '(') {
+				if end := matchingClose(text, i+1); end >= 0 {
+					i = end
+				}
+			}
+		case sep:
+			return text[:i], text[i+1:], true
+		}
+	}
+	return text, "", false
+}
+
+func trimPrefixPattern(value, pattern string, longest bool) string {
+	runes := []rune(value)
+	for n := range len(runes) + 1 {
+		if longest {
+			n = len(runes) - n
+		}
+		if matchPattern(pattern, string(runes[:n])) {
+			return string(runes[n:])
+		}
+	}
+	return value
+}
+
+func trimSuffixPattern(value, pattern string, longest bool) string {
+	runes := []rune(value)
+	for n := range len(runes) + 1 {
+		if !longest {
+			n = len(runes) - n
+		}
+		if matchPattern(pattern, string(runes[n:])) {
+			return string(runes[:n])
+		}
+	}
+	return value
+}
+
+// replacePattern implements ${VAR/pattern/rep}. With mode 0 only the first
+// longest match is replaced, '/' replaces every match, and '#' or '%'
+// anchor the match at the start or end of value.
+func replacePattern(value, pattern, rep string, mode byte) string {
+	if pattern == "" {
+		return value
+	}
+	runes := []rune(value)
+
+	switch mode {
+	case '#':
+		for n := len(runes); n >= 0; n-- {
+			if matchPattern(pattern, string(runes[:n])) {
+				return rep + string(runes[n:])
+			}
+		}
+		return value
+	case '%':
+		for n := 0; n <= len(runes); n++ {
+			if matchPattern(pattern, string(runes[n:])) {
+				return string(runes[:n]) + rep
+			}
+		}
+		return value
+	}
+
+	var sb strings.Builder
+	for start := 0; start < len(runes); {
+		end := -1
+		for n := len(runes); n > start; n-- {
+			if matchPattern(pattern, string(runes[start:n])) {
+				end = n
+				break
+			}
+		}
+		if end < 0 {
+			sb.WriteRune(runes[start])
+			start++
+			continue
+		}
+		sb.WriteString(rep)
+		if mode != '/' {
+			sb.WriteString(string(runes[end:]))
+			return sb.String()
+		}
+		start = end
+	}
+	return sb.String()
+}
+
+func convertCase(value, pattern string, convert func(rune) rune, all bool) string {
+	runes := []rune(value)
+	for i, r := range runes {
+		if matchPattern(pattern, string(r)) {
+			runes[i] = convert(r)
+		}
+		if !all {
+			break
+		}
+	}
+	return string(runes)
+}
+
+func (e *expander) writePositional(c byte, quoted bool) {
+	e.writeList(c, e.s.positional, quoted)
+}
+
+// writeList writes the expansion of $@ or $* (selected by c) with params
+// in place of the positional parameters.
+func (e *expander) writeList(c byte, params []string, quoted bool) {
+	if (c == '*' && quoted) || e.noSplit {
+		sep := " "
+		if ifs, ok := e.s.getVar("IFS"); ok {
+			sep = ifs[:min(1, len(ifs))]
+		}
+		e.write(strings.Join(params, sep), quoted)
+		return
+	}
+
+	for k, param := range params {
+		if quoted {
+			if k > 0 {
+				e.push()
+			}
+			e.write(param, true)
+			continue
+		}
+		if k > 0 && e.started {
+			e.push()
+		}
+		e.writeSplit(param)
+	}
+}
+
+// writeValue writes the value of an expansion, which is split into fields
+// unless it is quoted or splitting is off. An unquoted value that isn't
+// split still makes up patterns, as in case patterns.
+func (e *expander) writeValue(value string, quoted bool) {
+	if quoted || e.noSplit {
+		e.write(value, quoted)
+		return
+	}
+	e.writeSplit(value)
+}
+
+// write appends text to the current field without splitting it.
+func (e *expander) write(text string, quoted bool) {
+	if text != "" || quoted {
+		e.started = true
+	}
+	e.cur.WriteString(text)
+	if quoted {
+		e.pat.WriteString(escapePattern(text))
+	} else {
+		e.pat.WriteString(text)
+	}
+}
+
+// writeSplit appends the result of an unquoted expansion, breaking it into
+// fields on IFS. Runs of IFS whitespace separate fields; every other IFS
+// character terminates one, so it can produce empty fields.
+func (e *expander) writeSplit(text string) {
+	ifs, ok := e.s.getVar("IFS")
+	if !ok {
+		ifs = " \t\n"
+	}
+
+	pushedOnSpace := false
+	for _, r := range text {
+		if !strings.ContainsRune(ifs, r) {
+			e.cur.WriteRune(r)
+			e.pat.WriteRune(r)
+			e.started = true
+			pushedOnSpace = false
+			continue
+		}
+		if r == ' ' || r == '\t' || r == '\n' {
+			if e.started {
+				e.push()
+				pushedOnSpace = true
+			}
+			continue
+		}
+		if e.started || !pushedOnSpace {
+			e.push()
+		}
+		pushedOnSpace = false
+	}
+}
+
+func (e *expander) push() {
+	e.fields = append(e.fields, e.cur.String())
+	e.patterns = append(e.patterns, e.pat.String())
+	e.cur.Reset()
+	e.pat.Reset()
+	e.started = false
+}
+
+func (e *expander) finish() []string {
+	if e.started {
+		e.push()
+	}
+	return e.fields
+}
+
+// substitute runs source as a command substitution and writes its output
+// with trailing newlines removed.
+func (e *expander) substitute(source string, quoted bool) error {
+	output, err := e.s.commandSubstitution(source)
+	if err != nil {
+		return err
+	}
+	e.writeValue(output, quoted)
+	return nil
+}
+
+// commandSubstitution runs source in a subshell and returns what it wrote
+// to standard output. The exit status becomes $? of the calling shell.
+func (s *Shell) commandSubstitution(source string) (string, error) {
+	list, err := s.ParseInput(source)
+	if err == ErrUnexpectedEnd {
+		return "", fmt.Errorf("command substitution: %w", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	var output strings.Builder
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, r)
+		r.Close()
+		close(copied)
+	}()
+
+	cio := s.substitutionIO()
+	sub := s.subshell()
+	status := sub.executeList(list, CommandIO{Stdin: cio.Stdin, Stdout: w, Stderr: cio.Stderr})
+	w.Close()
+	<-copied
+
+	s.lastExitCode = status
+	s.substituted = true
+	return strings.TrimRight(output.String(), "\n"), nil
+}
+
+// substitutionIO returns the standard streams of the command being
+// expanded, or those of the shell outside of any command.
+func (s *Shell) substitutionIO() CommandIO {
+	if s.streams.Stdout == nil {
+		return s.stdio()
+	}
+	return s.streams
+}
+
+// processSubstitution starts source connected to a pipe and returns a
+// /dev/fd path for the shell's end of it, which stays open until the
+// command being executed finishes. For <(cmd) source writes to the pipe,
+// for >(cmd) it reads what is written to the path.
+func (s *Shell) processSubstitution(source string, output bool) (string, error) {
+	list, err := s.ParseInput(source)
+	if err == ErrUnexpectedEnd {
+		return "", fmt.Errorf("process substitution: %w", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	local, remote := r, w
+	cio := s.substitutionIO()
+	if output {
+		local, remote = w, r
+		cio.Stdin = r
+	} else {
+		cio.Stdout = w
+	}
+
+	// the command runs on after the one it is an argument of, whose
+	// redirections are undone by then
+	sub := s.subshell()
+	cio, release := sub.detach(cio)
+	go func() {
+		sub.executeList(list, cio)
+		remote.Close()
+		release()
+	}()
+
+	fd := int(local.Fd())
+	s.fds.SetFD(fd, local)
+	s.procSubs = append(s.procSubs, fd)
+	return fmt.Sprintf("/dev/fd/%d", fd), nil
+}
+
+// isCommandOpen reports whether text[open] is the parenthesis opening a
+// command substitution, $( but not $((, or a process substitution.
+func isCommandOpen(text string, open int) bool {
+	if open < 1 || open >= len(text) || text[open] != '(' {
+		return false
+	}
+	switch text[open-1] {
+	case '$':
+		return open+1 >= len(text) || text[open+1] != '('
+	case '<', '>':
+		return true
+	}
+	return false
+}
+
+// commandClose returns the index of the parenthesis closing the command
+// substitution opened at text[open], or -1. It is the first ) that the
+// command before it leaves unmatched, so that one in quotes, a comment, a
+// here-document or a case pattern is passed over.
+func commandClose(text string, open int) int {
+	for i := open + 1; i < len(text); i++ {
+		if text[i] != ')' {
+			continue
+		}
+		tokens, err := tokenize(text[open+1 : i+1])
+		if err == ErrUnexpectedEnd {
+			continue
+		}
+		if err != nil {
+			return i
+		}
+		if n := len(tokens); n == 0 || tokens[n-1].Type != TokenRParen {
+			continue
+		}
+		p := &parser{tokens: tokens[:len(tokens)-1]}
+		if _, err := p.parseList(); err == ErrUnexpectedEnd {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// closingBacktick returns the index of the backtick closing the one that
+// starts text, or -1.
+func closingBacktick(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '`':
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeBackticks removes the backslashes that quote \, ` and $ inside
+// a backquoted command substitution.
+func unescapeBackticks(text string) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && strings.IndexByte("\\`$", text[i+1]) >= 0 {
+			i++
+		}
+		sb.WriteByte(text[i])
+	}
+	return sb.String()
+}
+
+// matchingClose returns the index of the bracket that closes the one at
+// text[open], skipping quoted text and escaped characters, or -1. The end
+// of a command substitution is found by parsing the command.
+func matchingClose(text string, open int) int {
+	if isCommandOpen(text, open) {
+		return commandClose(text, open)
+	}
+	openCh := text[open]
+	closeCh := byte('}')
+	if openCh == '(' {
+		closeCh = ')'
+	}
+
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '$':
+			if isCommandOpen(text, i+1) {
+				if i = commandClose(text, i+1); i < 0 {
+					return -1
+				}
+			}
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		case '"':
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case openCh:
+			depth++
+		case closeCh:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
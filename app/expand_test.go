@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCommandSubstitutionEnd checks that a ) in a case pattern, quotes, a
+// comment or a here-document doesn't end a command substitution.
+func TestCommandSubstitutionEnd(t *testing.T) {
+	tests := map[string]string{
+		"$(case x in x) echo y;; esac)":              "y",
+		"\"$(case x in (x) echo q;; esac)\"":         "q",
+		"$(echo \")\" ')')":                          ") )",
+		"$(echo a # )\n)":                            "a",
+		"$(cat <<E\n)\nE\n)":                         ")",
+		"${u:-$(case a in a) echo def;; esac)}":      "def",
+		"$(echo $(case z in z) echo nested;; esac))": "nested",
+	}
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for source, want := range tests {
+		fields, err := s.expandWords([]*Word{parseWord(t, s, source)})
+		if err != nil || strings.Join(fields, " ") != want {
+			t.Errorf("%q expands to %q, %v; want %q", source, fields, err, want)
+		}
+	}
+}
+
+// TestOperandPatternFromVariable checks that the pattern operand of a trim
+// or replacement matches with the glob characters of an unquoted variable,
+// also inside double quotes, and literally with those of a quoted one.
+func TestOperandPatternFromVariable(t *testing.T) {
+	tests := map[string]string{
+		"${v#$p}":       "b.c",
+		"${v##$p}":      "c",
+		"${v%$s}":       "a.b",
+		"${v%%$s}":      "a",
+		"${v/$p/X}":     "Xc",
+		"${v//$s/-}":    "a-",
+		"${v#\"$p\"}":   "a.b.c",
+		"\"${v/$p/X}\"": "Xc",
+		"\"${v#a.*}\"":  "b.c",
+		"${l#\"$p\"}":   "b",
+		"${l#$p}":       "b",
+	}
+	s, err := newShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setVar("v", "a.b.c")
+	s.setVar("l", "*.b")
+	s.setVar("p", "*.")
+	s.setVar("s", ".*")
+	for source, want := range tests {
+		fields, err := s.expandWords([]*Word{parseWord(t, s, source)})
+		if err != nil || strings.Join(fields, " ") != want {
+			t.Errorf("%q expands to %q, %v; want %q", source, fields, err, want)
+		}
+	}
+}
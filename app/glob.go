@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// matchPattern reports whether the whole of s matches the shell pattern.
+// A backslash in the pattern makes the next character literal.
+func matchPattern(pattern, s string) bool {
+	return matchRunes([]rune(pattern), []rune(s), false)
+}
+
+// matchExtPattern is matchPattern with the extglob operators ?(...),
+// *(...), +(...), @(...) and !(...) recognised.
+func matchExtPattern(pattern, s string) bool {
+	return matchRunes([]rune(pattern), []rune(s), true)
+}
+
+func matchRunes(p, s []rune, extglob bool) bool {
+	for len(p) > 0 {
+		if extglob && isExtglobStart(p) {
+			if end := extglobEnd(p); end > 0 {
+				return matchExtglob(p[0], splitAlternatives(p[2:end]), p[end+1:], s)
+			}
+		}
+
+		switch p[0] {
+		case '*':
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchRunes(p, s[i:], extglob) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			p, s = p[1:], s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			if matched, width, ok := matchBracket(p, s[0]); ok {
+				if !matched {
+					return false
+				}
+				p, s = p[width:], s[1:]
+				continue
+			}
+			if s[0] != '[' {
+				return false
+			}
+			p, s = p[1:], s[1:]
+
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || p[0] != s[0] {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+func isExtglobStart(p []rune) bool {
+	return len(p) > 1 && p[1] == '(' && strings.ContainsRune("?*+@!", p[0])
+}
+
+// extglobEnd returns the index of the parenthesis closing the extglob
+// group at the start of p, or -1 when it is not closed.
+func extglobEnd(p []rune) int {
+	depth := 0
+	for i := 1; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitAlternatives splits the body of an extglob group on the | that are
+// not nested in another group.
+func splitAlternatives(p []rune) [][]rune {
+	var alternatives [][]rune
+	depth, start := 0, 0
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 {
+				alternatives = append(alternatives, p[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(alternatives, p[start:])
+}
+
+// matchExtglob matches s against the extglob group op(alternatives)
+// followed by the rest of the pattern.
+func matchExtglob(op rune, alternatives [][]rune, rest, s []rune) bool {
+	matchesAny := func(t []rune) bool {
+		for _, alt := range alternatives {
+			if matchRunes(alt, t, true) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// repeat matches one or more occurrences of the group before rest
+	var repeat func(s []rune) bool
+	repeat = func(s []rune) bool {
+		for k := 1; k <= len(s); k++ {
+			if matchesAny(s[:k]) && (matchRunes(rest, s[k:], true) || repeat(s[k:])) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch op {
+	case '*':
+		return matchRunes(rest, s, true) || repeat(s)
+	case '+':
+		return (matchesAny(nil) && matchRunes(rest, s, true)) || repeat(s)
+	case '!':
+		for k := 0; k <= len(s); k++ {
+			if !matchesAny(s[:k]) && matchRunes(rest, s[k:], true) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// ?(...) and @(...)
+	if op == '?' && matchRunes(rest, s, true) {
+		return true
+	}
+	for k := 0; k <= len(s); k++ {
+		if matchesAny(s[:k]) && matchRunes(rest, s[k:], true) {
+			return true
+		}
+	}
+	return false
+}
+
+var charClasses = map[string]func(rune) bool{
+	"alnum":  func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) },
+	"alpha":  unicode.IsLetter,
+	"blank":  func(r rune) bool { return r == ' ' || r == '\t' },
+	"cntrl":  unicode.IsControl,
+	"digit":  unicode.IsDigit,
+	"graph":  func(r rune) bool { return unicode.IsGraphic(r) && !unicode.IsSpace(r) },
+	"lower":  unicode.IsLower,
+	"print":  unicode.IsPrint,
+	"punct":  unicode.IsPunct,
+	"space":  unicode.IsSpace,
+	"upper":  unicode.IsUpper,
+	"xdigit": func(r rune) bool { return strings.ContainsRune("0123456789abcdefABCDEF", r) },
+}
+
+// matchBracket matches c against the bracket expression at the start of p.
+// It returns the width of the expression, or ok=false when p does not hold
+// a complete bracket expression and the [ should be taken literally.
+func matchBracket(p []rune, c rune) (matched bool, width int, ok bool) {
+	i := 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	for first := true; i < len(p); first = false {
+		if p[i] == ']' && !first {
+			return matched != negate, i + 1, true
+		}
+
+		if p[i] == '[' && i+1 < len(p) && p[i+1] == ':' {
+			end := strings.Index(string(p[i+2:]), ":]")
+			if end >= 0 {
+				name := string(p[i+2:])[:end]
+				if class, known := charClasses[name]; known && class(c) {
+					matched = true
+				}
+				i += 2 + len([]rune(name)) + 2
+				continue
+			}
+		}
+
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			hi = p[i+2]
+			if hi == '\\' && i+3 < len(p) {
+				i++
+				hi = p[i+2]
+			}
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0, false
+}
+
+// escapePattern makes every character of s match literally.
+func escapePattern(s string) string {
+	if !strings.ContainsAny(s, `*?[]\()|`) {
+		return s
+	}
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\()|`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// unescapePattern removes the backslashes that make pattern characters
+// literal.
+func unescapePattern(p string) string {
+	if !strings.Contains(p, `\`) {
+		return p
+	}
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+1 < len(p) {
+			i++
+		}
+		sb.WriteByte(p[i])
+	}
+	return sb.String()
+}
+
+// hasGlobMeta reports whether pattern holds an unescaped *, ?, complete
+// bracket expression or, with extglob, an extglob group.
+func hasGlobMeta(pattern string, extglob bool) bool {
+	p := []rune(pattern)
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '*', '?':
+			return true
+		case '[':
+			if _, _, ok := matchBracket(p[i:], 0); ok {
+				return true
+			}
+		case '+', '@', '!':
+			if extglob && isExtglobStart(p[i:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandPathnames replaces each field whose pattern holds unquoted glob
+// characters with the sorted paths it matches. Fields that match nothing
+// are kept as they are unless nullglob or failglob is set.
+func (s *Shell) expandPathnames(fields, patterns []string) ([]string, error) {
+	var result []string
+	for i, field := range fields {
+		if !hasGlobMeta(patterns[i], s.shopts["extglob"]) {
+			result = append(result, field)
+			continue
+		}
+
+		matches := s.glob(patterns[i])
+		switch {
+		case len(matches) > 0:
+			result = append(result, matches...)
+		case s.shopts["failglob"]:
+			return nil, fmt.Errorf("no match: %s", field)
+		case !s.shopts["nullglob"]:
+			result = append(result, field)
+		}
+	}
+	return result, nil
+}
+
+// glob returns the sorted paths matching pattern, which is resolved
+// against the working directory unless it is absolute. Matches keep the
+// form of the pattern, so relative patterns give relative paths.
+func (s *Shell) glob(pattern string) []string {
+	components := strings.Split(pattern, "/")
+	// every prefix is a directory path ending in /, or empty for the
+	// working directory
+	prefixes := []string{""}
+	if components[0] == "" {
+		prefixes = []string{"/"}
+		components = components[1:]
+	}
+
+	for i, component := range components {
+		last := i == len(components)-1
+		var next []string
+		for _, prefix := range prefixes {
+			next = append(next, s.globComponent(prefix, component, last)...)
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		prefixes = next
+	}
+
+	slices.Sort(prefixes)
+	return slices.Compact(prefixes)
+}
+
+// globComponent matches one path component in the directory named by
+// prefix. Unless last is set only directories match, and they are
+// returned with a trailing slash so they can prefix the next component.
+func (s *Shell) globComponent(prefix, component string, last bool) []string {
+	dir := prefix
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.workingDir, prefix)
+	}
+
+	switch {
+	case component == "":
+		// a doubled or trailing slash
+		return []string{prefix}
+
+	case component == "**" && s.shopts["globstar"]:
+		return s.globstar(prefix, dir, last)
+
+	case !hasGlobMeta(component, s.shopts["extglob"]):
+		name := unescapePattern(component)
+		info, err := os.Stat(filepath.Join(dir, name))
+		if last {
+			if _, lerr := os.Lstat(filepath.Join(dir, name)); lerr != nil {
+				return nil
+			}
+			return []string{prefix + name}
+		}
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		return []string{prefix + name + "/"}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	matchHidden := s.shopts["dotglob"] || strings.HasPrefix(component, ".") || strings.HasPrefix(component, `\.`)
+
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !matchHidden {
+			continue
+		}
+		if !matchRunes([]rune(component), []rune(name), s.shopts["extglob"]) {
+			continue
+		}
+		if last {
+			matches = append(matches, prefix+name)
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+			matches = append(matches, prefix+name+"/")
+		}
+	}
+	return matches
+}
+
+// globstar expands ** to the directory itself and every directory below
+// it or, as the last component, to every file and directory below it.
+// Symbolic links to directories are not followed.
+func (s *Shell) globstar(prefix, dir string, last bool) []string {
+	var matches []string
+	if !last || prefix != "" {
+		matches = append(matches, prefix)
+	}
+
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") && !s.shopts["dotglob"] {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			if last {
+				matches = append(matches, prefix+rel)
+			} else {
+				matches = append(matches, prefix+rel+"/")
+			}
+		} else if last {
+			matches = append(matches, prefix+rel)
+		}
+		return nil
+	})
+	return matches
+}
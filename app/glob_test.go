@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+// TestMatchPattern checks bracket expressions, character classes and
+// escapes, and with extglob set the extglob operators.
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		extglob    bool
+		want       bool
+	}{
+		{"a*c", "abbc", false, true},
+		{"a?c", "ac", false, false},
+		{"[abc]x", "bx", false, true},
+		{"[a-c]", "d", false, false},
+		{"[!a-c]", "d", false, true},
+		{"[^a-c]", "b", false, false},
+		{"[]a]", "]", false, true},
+		{"[a-]", "-", false, true},
+		{"[[:digit:]][[:alpha:]]", "1x", false, true},
+		{"[[:upper:]]", "a", false, false},
+		{"[![:space:]]", " ", false, false},
+		{"[a", "[a", false, true},
+		{`\*`, "*", false, true},
+		{`\*`, "x", false, false},
+		{`[\]]`, "]", false, true},
+		{"@(ab|cd)", "cd", true, true},
+		{"@(ab|cd)", "abcd", true, false},
+		{"?(x)y", "y", true, true},
+		{"?(x)y", "xxy", true, false},
+		{"*(ab)c", "ababc", true, true},
+		{"+(ab)c", "c", true, false},
+		{"+(a|b)", "abba", true, true},
+		{"!(*.go)", "main.go", true, false},
+		{"!(*.go)", "main.c", true, true},
+		{"a!(b)c", "abc", true, false},
+		{"@(a*(b))", "abbb", true, true},
+		{"@(ab|cd)", "@(ab|cd)", false, true},
+	}
+	for _, test := range tests {
+		got := matchRunes([]rune(test.pattern), []rune(test.s), test.extglob)
+		if got != test.want {
+			t.Errorf("%s matching %q (extglob %v) = %v, want %v", test.pattern, test.s, test.extglob, got, test.want)
+		}
+	}
+}
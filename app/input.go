@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+)
+
+// LineSource supplies the commands the shell runs, a line at a time. The
+// terminal is the source of an interactive shell; scripts, -c strings and
+// piped input are read through a readerSource.
+type LineSource interface {
+	ReadLine() (string, error)
+	SetPrompt(prompt string)
+}
+
+// readerSource reads lines from r. It reads a byte at a time so that
+// commands run by the shell can read the rest of the same input, as read
+// does in a script piped to the shell; wrap r in a bufio.Reader when
+// nothing else reads from it.
+type readerSource struct {
+	r   io.Reader
+	eof bool
+}
+
+func newReaderSource(r io.Reader) *readerSource {
+	return &readerSource{r: r}
+}
+
+// ReadLine returns the next line without its newline, and io.EOF once the
+// input is exhausted. A last line without a newline is still returned.
+func (rs *readerSource) ReadLine() (string, error) {
+	if rs.eof {
+		return "", io.EOF
+	}
+	line, complete := readLine(rs.r, true)
+	if !complete {
+		rs.eof = true
+		if line == "" {
+			return "", io.EOF
+		}
+	}
+	return line, nil
+}
+
+// SetPrompt does nothing, as no prompts are shown for non-interactive input.
+func (rs *readerSource) SetPrompt(prompt string) {}
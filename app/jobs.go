@@ -0,0 +1,767 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// initJobControl puts the shell in a process group of its own in the
+// foreground of the terminal tty, so that each job can be given a group
+// that takes the terminal while it runs.
+func (s *Shell) initJobControl(tty int) error {
+	if unix.Getpgrp() != os.Getpid() {
+		if err := unix.Setpgid(0, 0); err != nil {
+			return err
+		}
+	}
+	s.tty = tty
+	s.setForeground(unix.Getpgrp())
+
+	// keys typed while the shell itself runs a command must not stop or
+	// kill it, though Ctrl-C interrupts wait
+	s.interrupts = make(chan struct{}, 1)
+	signal.Notify(s.sigChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP)
+	go func() {
+		for sig := range s.sigChan {
+			if sig == syscall.SIGINT {
+				select {
+				case s.interrupts <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// setForeground makes pgid the foreground process group of the terminal.
+// The shell may be in the background itself, so SIGTTOU is ignored
+// meanwhile; holding ForkLock keeps new children from inheriting that.
+func (s *Shell) setForeground(pgid int) {
+	syscall.ForkLock.Lock()
+	defer syscall.ForkLock.Unlock()
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	unix.IoctlSetPointerInt(s.tty, unix.TIOCSPGRP, pgid)
+}
+
+// executeForegroundJob runs pipeline as a job whose processes share a new
+// process group, which owns the terminal until they finish or stop. A
+// stopped job is added to the job table.
+func (s *Shell) executeForegroundJob(pipeline *PipeSequence, cio CommandIO) int {
+	pg := NewProcessGroup()
+	pg.SetForeground(true)
+	s.pgroup = pg
+	status := s.runPipeSequence(pipeline, cio)
+	s.pgroup = nil
+	if pg.LastPID() == -1 {
+		pg.SetForeground(false)
+		return status
+	}
+
+	var job *Job
+	if pg.Stopped() {
+		job = s.addJob(pg, pipeline.String(), false)
+	}
+	s.reclaimTerminal(pg, job, cio)
+	return status
+}
+
+// continueForeground gives the terminal to job and continues it, then
+// waits until it finishes or stops again and returns its status.
+func (s *Shell) continueForeground(job *Job, cio CommandIO) int {
+	pg := job.ProcessGroup
+	job.Background = false
+	if job.termState != nil {
+		term.Restore(s.tty, job.termState)
+	}
+	pg.SetForeground(true)
+	if pgid := pg.Pgid(); pgid != -1 {
+		s.setForeground(pgid)
+	}
+	pg.Continue()
+	for !s.waitJobs(func() bool { return pg.State() != JobRunning }) {
+	}
+
+	s.reclaimTerminal(pg, job, cio)
+	if pg.Stopped() {
+		return 128 + int(pg.StopSignal())
+	}
+	s.removeJob(job)
+	status, _ := pg.Result()
+	return status
+}
+
+// reclaimTerminal takes the terminal back from the job running in pg and
+// sets the shell's own modes on it again. A stopped job keeps its modes
+// for when it returns to the foreground.
+func (s *Shell) reclaimTerminal(pg *ProcessGroup, job *Job, cio CommandIO) {
+	pg.SetForeground(false)
+	s.setForeground(unix.Getpgrp())
+	if pg.Interrupted() {
+		s.flow = flowInterrupt
+		s.Write(cio.Stderr, "\n")
+	}
+	if job != nil && pg.Stopped() {
+		job.termState, _ = term.GetState(s.tty)
+		job.Status = JobStopped
+		s.touchJob(job)
+		s.Write(cio.Stderr, "\n"+s.jobLine(job, JobStopped, false)+"\n")
+	}
+	if s.termPrevState != nil {
+		term.Restore(s.tty, s.termPrevState)
+	}
+}
+
+// addJob adds a job for the processes of pg to the job table, numbered
+// one above the highest job in it.
+func (s *Shell) addJob(pg *ProcessGroup, text string, background bool) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := 1
+	for existing := range s.jobs {
+		id = max(id, existing+1)
+	}
+	s.jobSeq++
+	job := &Job{
+		ID:           id,
+		Text:         text,
+		ProcessGroup: pg,
+		Background:   background,
+		Status:       JobRunning,
+		StartTime:    time.Now(),
+		seq:          s.jobSeq,
+	}
+	s.jobs[id] = job
+
+	events, changes := s.jobEvents, s.jobChanges
+	pg.SetNotify(func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	return job
+}
+
+// inheritedJobs returns copies of the jobs for a subshell.
+func (s *Shell) inheritedJobs() map[int]*Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := make(map[int]*Job, len(s.jobs))
+	for id, job := range s.jobs {
+		inherited := *job
+		inherited.inherited = true
+		jobs[id] = &inherited
+	}
+	return jobs
+}
+
+// touchJob makes job the most recently used one.
+func (s *Shell) touchJob(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobSeq++
+	job.seq = s.jobSeq
+}
+
+func (s *Shell) removeJob(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, job.ID)
+}
+
+// sortedJobs returns the jobs in the table by number.
+func (s *Shell) sortedJobs() []*Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, id := range slices.Sorted(maps.Keys(s.jobs)) {
+		jobs = append(jobs, s.jobs[id])
+	}
+	return jobs
+}
+
+// currentJobs returns the current job, %+, and the previous one, %-. The
+// most recently stopped jobs come first, then the most recently started
+// or continued ones.
+func (s *Shell) currentJobs() (current, previous *Job) {
+	jobs := s.sortedJobs()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rank := func(job *Job) int {
+		if job.ProcessGroup.Stopped() {
+			return job.seq + s.jobSeq
+		}
+		return job.seq
+	}
+	for _, job := range jobs {
+		switch {
+		case current == nil || rank(job) > rank(current):
+			current, previous = job, current
+		case previous == nil || rank(job) > rank(previous):
+			previous = job
+		}
+	}
+	return current, previous
+}
+
+// jobMark returns + for the current job, - for the previous one and a
+// space for the others.
+func (s *Shell) jobMark(job *Job) rune {
+	current, previous := s.currentJobs()
+	switch job {
+	case current:
+		return '+'
+	case previous:
+		return '-'
+	}
+	return ' '
+}
+
+// findJob returns the job named by spec: %n or n for job n, %+, %% or %
+// for the current job and %- for the previous one, %name for the job
+// whose command starts with name and %?text for one that contains text.
+func (s *Shell) findJob(spec string) (*Job, error) {
+	name := strings.TrimPrefix(spec, "%")
+	current, previous := s.currentJobs()
+	var job *Job
+	switch {
+	case name == "" || name == "+" || name == "%":
+		job = current
+	case name == "-":
+		job = previous
+		if job == nil {
+			job = current
+		}
+	case isAllDigits(name):
+		id, _ := strconv.Atoi(name)
+		s.mu.RLock()
+		job = s.jobs[id]
+		s.mu.RUnlock()
+	default:
+		for _, candidate := range s.sortedJobs() {
+			var matches bool
+			if text, ok := strings.CutPrefix(name, "?"); ok {
+				matches = strings.Contains(candidate.Text, text)
+			} else {
+				matches = strings.HasPrefix(candidate.Text, name)
+			}
+			if !matches {
+				continue
+			}
+			if job != nil {
+				return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+			}
+			job = candidate
+		}
+	}
+	if job == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return job, nil
+}
+
+// jobLine formats job in state as jobs lists it. long adds the process
+// group id.
+func (s *Shell) jobLine(job *Job, state JobStatus, long bool) string {
+	text := job.Text
+	if state == JobRunning && job.Background {
+		text += " &"
+	}
+	description := describeJobState(job.ProcessGroup, state)
+	if long {
+		return fmt.Sprintf("[%d]%c %d %-24s%s", job.ID, s.jobMark(job), job.ProcessGroup.Pgid(), description, text)
+	}
+	return fmt.Sprintf("[%d]%c  %-24s%s", job.ID, s.jobMark(job), description, text)
+}
+
+// reportJobs tells the user about the jobs that finished or stopped since
+// they were last reported or listed, and removes the finished ones.
+func (s *Shell) reportJobs() {
+	for _, job := range s.sortedJobs() {
+		state := job.ProcessGroup.State()
+		if state == JobRunning || state == job.Status {
+			// a job continued from elsewhere isn't reported
+			job.Status = state
+			continue
+		}
+		s.Write(os.Stderr, s.jobLine(job, state, false)+"\n")
+		job.Status = state
+		if state == JobCompleted {
+			s.removeJob(job)
+		}
+	}
+}
+
+// notifyJobs reports job changes as they happen under set -o notify, while
+// the shell waits at the prompt. Writing through the terminal redraws the
+// prompt and the line being edited below the report. Job changes at other
+// times wait for the next prompt.
+func (s *Shell) notifyJobs() {
+	for range s.jobChanges {
+		s.promptMu.Lock()
+		if s.prompting && s.options["notify"] {
+			s.reportJobs()
+		}
+		s.promptMu.Unlock()
+	}
+}
+
+// describeJobState names state for jobs: Running, Stopped with the signal
+// if it isn't SIGTSTP, and for a finished job Done, Exit and its status or
+// the signal that killed it.
+func describeJobState(pg *ProcessGroup, state JobStatus) string {
+	switch state {
+	case JobRunning:
+		return "Running"
+	case JobStopped:
+		if sig := pg.StopSignal(); sig != 0 && sig != syscall.SIGTSTP {
+			return fmt.Sprintf("Stopped(%s)", unix.SignalName(sig))
+		}
+		return "Stopped"
+	}
+
+	status, sig := pg.Result()
+	switch {
+	case sig != 0:
+		description := sig.String()
+		return strings.ToUpper(description[:1]) + description[1:]
+	case status == 0:
+		return "Done"
+	default:
+		return fmt.Sprintf("Exit %d", status)
+	}
+}
+
+// waitJobs waits until done reports true, checking again whenever a job
+// changes state. It returns false if Ctrl-C interrupts the wait first.
+func (s *Shell) waitJobs(done func() bool) bool {
+	select {
+	case <-s.interrupts:
+	default:
+	}
+	for !done() {
+		select {
+		case <-s.jobEvents:
+		case <-s.interrupts:
+			return false
+		}
+	}
+	return true
+}
+
+// parseSignal returns the signal given by number or by name, with or
+// without the SIG prefix.
+func parseSignal(spec string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 || n > 64 {
+			return 0, fmt.Errorf("%s: invalid signal specification", spec)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(spec)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("%s: invalid signal specification", spec)
+}
+
+// terminates reports whether sig ends a process that doesn't handle it.
+func terminates(sig syscall.Signal) bool {
+	switch sig {
+	case 0, syscall.SIGCHLD, syscall.SIGCONT, syscall.SIGURG, syscall.SIGWINCH,
+		syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		return false
+	}
+	return true
+}
+
+// JobsCmd lists the jobs, or those given as job specs. -l adds their
+// process group ids, -p prints only those, and -r and -s list only the
+// running or the stopped jobs. Finished jobs leave the table once listed.
+func (s *Shell) JobsCmd(args []string, io CommandIO) int {
+	var long, pidsOnly, running, stopped bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		option := args[0]
+		args = args[1:]
+		if option == "--" {
+			break
+		}
+		for _, flag := range option[1:] {
+			switch flag {
+			case 'l':
+				long = true
+			case 'p':
+				pidsOnly = true
+			case 'r':
+				running = true
+			case 's':
+				stopped = true
+			default:
+				s.Write(io.Stderr, fmt.Sprintf("jobs: -%c: invalid option\n", flag))
+				return 2
+			}
+		}
+	}
+
+	status := 0
+	jobs := s.sortedJobs()
+	if len(args) > 0 {
+		jobs = nil
+		for _, spec := range args {
+			job, err := s.findJob(spec)
+			if err != nil {
+				s.Write(io.Stderr, "jobs: "+err.Error()+"\n")
+				status = 1
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	for _, job := range jobs {
+		state := job.ProcessGroup.State()
+		if (running && state != JobRunning) || (stopped && state != JobStopped) {
+			continue
+		}
+		if pidsOnly {
+			if pgid := job.ProcessGroup.Pgid(); pgid != -1 {
+				s.Write(io.Stdout, fmt.Sprintf("%d\n", pgid))
+			}
+		} else {
+			s.Write(io.Stdout, s.jobLine(job, state, long)+"\n")
+		}
+		job.Status = state
+		if state == JobCompleted {
+			s.removeJob(job)
+		}
+	}
+	return status
+}
+
+// FgCmd continues a job, the current one by default, in the foreground
+// and waits for it like a job started there.
+func (s *Shell) FgCmd(args []string, io CommandIO) int {
+	if s.tty < 0 || s.subshellLevel > 0 {
+		s.Write(io.Stderr, "fg: no job control\n")
+		return 1
+	}
+	if len(args) > 1 {
+		s.Write(io.Stderr, fmt.Sprintf("fg: %v\n", ErrTooManyArguments))
+		return 2
+	}
+
+	spec := "%+"
+	if len(args) == 1 {
+		spec = args[0]
+	}
+	job, err := s.findJob(spec)
+	if err != nil {
+		s.Write(io.Stderr, "fg: "+err.Error()+"\n")
+		return 1
+	}
+	s.Write(io.Stdout, job.Text+"\n")
+	return s.continueForeground(job, io)
+}
+
+// BgCmd continues stopped jobs, the current one by default, in the
+// background.
+func (s *Shell) BgCmd(args []string, io CommandIO) int {
+	if s.tty < 0 || s.subshellLevel > 0 {
+		s.Write(io.Stderr, "bg: no job control\n")
+		return 1
+	}
+	if len(args) == 0 {
+		args = []string{"%+"}
+	}
+
+	status := 0
+	for _, spec := range args {
+		job, err := s.findJob(spec)
+		if err != nil {
+			s.Write(io.Stderr, "bg: "+err.Error()+"\n")
+			status = 1
+			continue
+		}
+		if !job.ProcessGroup.Stopped() {
+			s.Write(io.Stderr, fmt.Sprintf("bg: job %d already in background\n", job.ID))
+			continue
+		}
+		job.Background = true
+		job.Status = JobRunning
+		job.ProcessGroup.Continue()
+		s.touchJob(job)
+		s.Write(io.Stdout, fmt.Sprintf("[%d]%c %s &\n", job.ID, s.jobMark(job), job.Text))
+	}
+	return status
+}
+
+// KillCmd sends a signal, SIGTERM by default, to the processes given by
+// pid and to the jobs given by job spec. With -l it lists the signals
+// instead.
+func (s *Shell) KillCmd(args []string, io CommandIO) int {
+	if len(args) == 0 {
+		s.Write(io.Stderr, "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\n")
+		return 2
+	}
+
+	sig := syscall.SIGTERM
+	var err error
+	switch option := args[0]; {
+	case option == "-l" || option == "-L":
+		return s.listSignals(args[1:], io)
+	case option == "-s" || option == "-n":
+		if len(args) < 2 {
+			s.Write(io.Stderr, fmt.Sprintf("kill: %s: option requires an argument\n", option))
+			return 2
+		}
+		sig, err = parseSignal(args[1])
+		args = args[2:]
+	case option == "--":
+		args = args[1:]
+	case strings.HasPrefix(option, "-") && len(option) > 1:
+		sig, err = parseSignal(option[1:])
+		args = args[1:]
+	}
+	if err != nil {
+		s.Write(io.Stderr, "kill: "+err.Error()+"\n")
+		return 1
+	}
+
+	status := 0
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "%") {
+			job, err := s.findJob(arg)
+			if err != nil {
+				s.Write(io.Stderr, "kill: "+err.Error()+"\n")
+				status = 1
+			} else if err := job.ProcessGroup.Kill(sig); err != nil {
+				s.Write(io.Stderr, fmt.Sprintf("kill: %s: %v\n", arg, err))
+				status = 1
+			}
+			continue
+		}
+
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			s.Write(io.Stderr, fmt.Sprintf("kill: %s: arguments must be process or job IDs\n", arg))
+			status = 1
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			s.Write(io.Stderr, fmt.Sprintf("kill: (%d) - %v\n", pid, err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// listSignals lists the signal numbers and names for kill -l, or converts
+// each argument: a number, or the status of a process killed by a signal,
+// to a name and a name to a number.
+func (s *Shell) listSignals(args []string, io CommandIO) int {
+	if len(args) == 0 {
+		var sb strings.Builder
+		for sig := syscall.Signal(1); sig <= 31; sig++ {
+			fmt.Fprintf(&sb, "%2d) %s", sig, unix.SignalName(sig))
+			if sig%5 == 0 || sig == 31 {
+				sb.WriteString("\n")
+			} else {
+				sb.WriteString("\t")
+			}
+		}
+		s.Write(io.Stdout, sb.String())
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n > 128 {
+				n -= 128
+			}
+			if name := unix.SignalName(syscall.Signal(n)); name != "" {
+				s.Write(io.Stdout, strings.TrimPrefix(name, "SIG")+"\n")
+				continue
+			}
+		} else if sig, err := parseSignal(arg); err == nil {
+			s.Write(io.Stdout, fmt.Sprintf("%d\n", sig))
+			continue
+		}
+		s.Write(io.Stderr, fmt.Sprintf("kill: %s: invalid signal specification\n", arg))
+		status = 1
+	}
+	return status
+}
+
+// WaitCmd waits for the jobs and processes given, or for all the jobs,
+// and returns the status of the last one given. With -n it waits for the
+// next of them to finish and returns its status. The jobs waited for leave
+// the table.
+func (s *Shell) WaitCmd(args []string, io CommandIO) int {
+	next := len(args) > 0 && args[0] == "-n"
+	if next {
+		args = args[1:]
+	}
+
+	status := 0
+	var jobs []*Job
+	for _, job := range s.sortedJobs() {
+		if !job.inherited {
+			jobs = append(jobs, job)
+		}
+	}
+	if len(args) > 0 {
+		jobs = nil
+		for _, arg := range args {
+			job, err := s.waitTarget(arg)
+			if err != nil {
+				s.Write(io.Stderr, "wait: "+err.Error()+"\n")
+				status = 127
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	if next {
+		if len(jobs) == 0 {
+			return 127
+		}
+		var finished *Job
+		done := func() bool {
+			for _, job := range jobs {
+				if job.ProcessGroup.State() == JobCompleted {
+					finished = job
+					return true
+				}
+			}
+			return false
+		}
+		if !s.waitJobs(done) {
+			return 128 + int(syscall.SIGINT)
+		}
+		s.removeJob(finished)
+		status, _ = finished.ProcessGroup.Result()
+		return status
+	}
+
+	for _, job := range jobs {
+		pg := job.ProcessGroup
+		if !s.waitJobs(func() bool { return pg.State() != JobRunning }) {
+			return 128 + int(syscall.SIGINT)
+		}
+		if pg.Stopped() {
+			status = 128 + int(pg.StopSignal())
+			continue
+		}
+		s.removeJob(job)
+		if len(args) > 0 {
+			status, _ = pg.Result()
+		}
+	}
+	return status
+}
+
+// waitTarget returns the job named by a job spec, or the job with the
+// process given by pid, among those started by this shell.
+func (s *Shell) waitTarget(arg string) (*Job, error) {
+	if strings.HasPrefix(arg, "%") {
+		job, err := s.findJob(arg)
+		if err == nil && job.inherited {
+			return nil, fmt.Errorf("%s: no such job", arg)
+		}
+		return job, err
+	}
+	pid, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("`%s': not a pid or valid job spec", arg)
+	}
+	for _, job := range s.sortedJobs() {
+		if !job.inherited && slices.Contains(job.ProcessGroup.PIDs(), pid) {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("pid %d is not a child of this shell", pid)
+}
+
+// DisownCmd removes jobs, the current one by default, from the job table.
+// -a removes all of them and -r all the running ones.
+func (s *Shell) DisownCmd(args []string, io CommandIO) int {
+	var all, running bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		option := args[0]
+		args = args[1:]
+		if option == "--" {
+			break
+		}
+		for _, flag := range option[1:] {
+			switch flag {
+			case 'a':
+				all = true
+			case 'r':
+				running = true
+			default:
+				s.Write(io.Stderr, fmt.Sprintf("disown: -%c: invalid option\n", flag))
+				return 2
+			}
+		}
+	}
+
+	status := 0
+	var jobs []*Job
+	switch {
+	case len(args) > 0:
+		for _, spec := range args {
+			job, err := s.findJob(spec)
+			if err != nil {
+				s.Write(io.Stderr, "disown: "+err.Error()+"\n")
+				status = 1
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+	case all || running:
+		jobs = s.sortedJobs()
+	default:
+		job, err := s.findJob("%+")
+		if err != nil {
+			s.Write(io.Stderr, "disown: "+err.Error()+"\n")
+			return 1
+		}
+		jobs = append(jobs, job)
+	}
+
+	for _, job := range jobs {
+		if running && !all && job.ProcessGroup.State() != JobRunning {
+			continue
+		}
+		s.removeJob(job)
+	}
+	return status
+}
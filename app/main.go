@@ -1,15 +1,84 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
 )
 
+const usage = "usage: goson [-l] [-s] [args ...]\n       goson [-l] -c command [name [args ...]]\n       goson [-l] script [args ...]\n"
+
 func main() {
+	args := os.Args[1:]
+	command, readStdin := false, false
+	// a login shell is started with a name beginning with - or with -l
+	login := strings.HasPrefix(os.Args[0], "-")
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		option := args[0]
+		args = args[1:]
+		if option == "--" {
+			break
+		}
+		switch option {
+		case "-c":
+			command = true
+		case "-s":
+			readStdin = true
+		case "-l", "--login":
+			login = true
+		default:
+			fmt.Fprintf(os.Stderr, "goson: %s: invalid option\n%s", option, usage)
+			os.Exit(2)
+		}
+	}
+
+	var input LineSource
+	name := "goson"
+	switch {
+	case command:
+		// the shell runs itself this way for subshells that need a
+		// process of their own
+		if len(args) == 0 {
+			fmt.Fprintf(os.Stderr, "goson: -c: option requires an argument\n%s", usage)
+			os.Exit(2)
+		}
+		input = newReaderSource(strings.NewReader(args[0]))
+		args = args[1:]
+		if len(args) > 0 {
+			name, args = args[0], args[1:]
+		}
+	case !readStdin && len(args) > 0:
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "goson: %s: %v\n", args[0], err.(*os.PathError).Err)
+			os.Exit(127)
+		}
+		input = newReaderSource(bufio.NewReader(f))
+		name, args = args[0], args[1:]
+	case !term.IsTerminal(int(os.Stdin.Fd())):
+		input = newReaderSource(os.Stdin)
+	}
+
+	if input != nil {
+		s, err := NewScriptShell(input, name, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.login = login
+		os.Exit(s.RunScript())
+	}
+
 	s, err := NewShell()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer s.Close()
+	s.positional = args
+	s.login = login
 
 	err = s.Run()
 	if err != nil {
@@ -1,307 +1,1117 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
-func tokenize(command string) ([]string, error) {
+type TokenType int
+
+const (
+	TokenWord TokenType = iota
+	TokenRedirect
+	TokenPipe
+	TokenPipeAll
+	TokenBackground
+	TokenAnd
+	TokenOr
+	TokenSemicolon
+	// TokenArithCommand is a whole ((expression)), Value holds the expression.
+	TokenArithCommand
+	TokenNewline
+	TokenLParen
+	TokenRParen
+	// TokenDoubleSemicolon, TokenSemicolonAnd and TokenDoubleSemicolonAnd
+	// are the ;;, ;& and ;;& that end a case item.
+	TokenDoubleSemicolon
+	TokenSemicolonAnd
+	TokenDoubleSemicolonAnd
+)
+
+type Token struct {
+	Type  TokenType
+	Value string
+	Word  *Word
+	// Here is the body of the here-document started by a << or <<- token.
+	Here string
+}
+
+type QuoteKind int
+
+const (
+	Unquoted QuoteKind = iota
+	SingleQuoted
+	DoubleQuoted
+)
+
+// WordPart is a run of characters from a word that share a quoting context.
+// Backslash-escaped characters are recorded as SingleQuoted since they are
+// taken literally.
+type WordPart struct {
+	Text  string
+	Quote QuoteKind
+}
+
+type Word struct {
+	Raw   string
+	Parts []WordPart
+}
+
+func (w *Word) String() string { return w.Raw }
+
+// Literal returns the word with quoting removed.
+func (w *Word) Literal() string {
+	var sb strings.Builder
+	for _, part := range w.Parts {
+		sb.WriteString(part.Text)
+	}
+	return sb.String()
+}
+
+// IsQuoted reports whether any part of the word was quoted or escaped.
+func (w *Word) IsQuoted() bool {
+	for _, part := range w.Parts {
+		if part.Quote != Unquoted {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Word) addPart(text string, quote QuoteKind) {
+	if n := len(w.Parts); n > 0 && w.Parts[n-1].Quote == quote {
+		w.Parts[n-1].Text += text
+		return
+	}
+	w.Parts = append(w.Parts, WordPart{Text: text, Quote: quote})
+}
+
+func isAllDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func tokenize(command string) ([]Token, error) {
 	runes := []rune(command)
-	var tokens []string
+	var tokens []Token
 
 	var currentQuote rune = 0
-	var token strings.Builder
-
-	flushToken := func() {
-		if token.Len() > 0 {
-			tokens = append(tokens, token.String())
-			token.Reset()
+	var word *Word
+	wordStart := 0
+	// extglobDepth counts the extglob groups such as @(a|b) open in the
+	// current word; inside them operator characters belong to the word.
+	extglobDepth := 0
+	// hereDocs holds the << and <<- tokens whose bodies follow the next
+	// newline.
+	var hereDocs []int
+
+	startWord := func(i int) {
+		if word == nil {
+			word = &Word{}
+			wordStart = i
+		}
+	}
+	flushToken := func(i int) {
+		if word != nil {
+			word.Raw = string(runes[wordStart:i])
+			tokens = append(tokens, Token{Type: TokenWord, Value: word.Literal(), Word: word})
+			word = nil
+		}
+	}
+	// takeFD returns the pending word as a file descriptor prefix for a
+	// redirection operator when it consists only of unquoted digits.
+	takeFD := func(i int) string {
+		if word != nil && !word.IsQuoted() && isAllDigits(word.Literal()) {
+			fd := word.Literal()
+			word = nil
+			return fd
+		}
+		flushToken(i)
+		return ""
+	}
+	// skipExpansion returns the index of the rune closing the ${, $( or `
+	// that starts at runes[i], or -1 when the input ends first.
+	skipExpansion := func(i int) int {
+		text := string(runes[i:])
+		end := -1
+		if text[0] == '`' {
+			end = closingBacktick(text)
+		} else {
+			end = matchingClose(text, 1)
+		}
+		if end < 0 {
+			return -1
+		}
+		return i + utf8.RuneCountInString(text[:end])
+	}
+	isExpansionStart := func(i int) bool {
+		return runes[i] == '`' || (runes[i] == '$' && i+1 < len(runes) && (runes[i+1] == '{' || runes[i+1] == '('))
+	}
+	// dupTarget consumes the "-" or digits that may follow >& and <&.
+	dupTarget := func(i int, op *strings.Builder) int {
+		if i+1 < len(runes) && runes[i+1] == '-' {
+			i++
+			op.WriteRune('-')
+			return i
 		}
+		for i+1 < len(runes) && unicode.IsDigit(runes[i+1]) {
+			i++
+			op.WriteRune(runes[i])
+		}
+		return i
 	}
 
 	i := 0
 	for i < len(runes) {
 		r := runes[i]
 
-		if r == '\'' || r == '"' {
-			if currentQuote == 0 {
-				currentQuote = r
-			} else if currentQuote == r {
+		if currentQuote == '\'' {
+			if r == '\'' {
 				currentQuote = 0
 			} else {
-				token.WriteRune(r)
+				word.addPart(string(r), SingleQuoted)
 			}
 			i++
 			continue
 		}
 
-		if currentQuote == 0 {
-			if unicode.IsSpace(r) {
-				flushToken()
-				i++
-				continue
-			}
-
-			if unicode.IsDigit(r) && token.Len() == 0 {
-				token.WriteRune(runes[i])
-				for i+1 < len(runes) && unicode.IsDigit(runes[i+1]) {
-					i++
-					token.WriteRune(runes[i])
+		if currentQuote == '"' {
+			switch {
+			case r == '"':
+				currentQuote = 0
+			case isExpansionStart(i):
+				end := skipExpansion(i)
+				if end < 0 {
+					return tokens, ErrUnexpectedEnd
 				}
-				i++
-			}
-
-			switch r {
-			case '|':
-				flushToken()
-				if i+1 < len(runes) && runes[i+1] == '&' {
-					tokens = append(tokens, "|&")
-					i += 2
-				} else {
-					tokens = append(tokens, "|")
+				word.addPart(string(runes[i:end+1]), DoubleQuoted)
+				i = end
+			case r == '\\':
+				if i+1 >= len(runes) {
+					return tokens, ErrUnexpectedEnd
+				}
+				switch next := runes[i+1]; next {
+				case '\n':
+					i++
+				case '\\', '$', '"', '`':
+					word.addPart(string(next), SingleQuoted)
 					i++
+				default:
+					word.addPart("\\", DoubleQuoted)
 				}
+			default:
+				word.addPart(string(r), DoubleQuoted)
+			}
+			i++
+			continue
+		}
 
-			case '&':
-				flushToken()
-				tokens = append(tokens, "&")
-				i++
+		switch {
+		case extglobDepth > 0 && strings.ContainsRune("()|&;<> \t\n", r):
+			if r == '(' {
+				extglobDepth++
+			} else if r == ')' {
+				extglobDepth--
+			}
+			word.addPart(string(r), Unquoted)
+			i++
 
-			case '>':
-				if _, err := strconv.Atoi(token.String()); err != nil {
-					flushToken()
-				}
-				token.WriteRune('>')
+		case strings.ContainsRune("?*+@!", r) && i+1 < len(runes) && runes[i+1] == '(':
+			startWord(i)
+			word.addPart(string(r)+"(", Unquoted)
+			extglobDepth++
+			i += 2
+
+		case r == '\'' || r == '"':
+			startWord(i)
+			currentQuote = r
+			if r == '\'' {
+				word.addPart("", SingleQuoted)
+			} else {
+				word.addPart("", DoubleQuoted)
+			}
+			i++
 
-				if i+1 < len(runes) {
-					switch runes[i+1] {
-					case '&':
-						i++
-						token.WriteRune('&')
-
-						if i+1 < len(runes) {
-							if runes[i+1] == '-' {
-								i++
-								token.WriteRune(runes[i])
-							} else {
-								for i+1 < len(runes) && unicode.IsDigit(runes[i+1]) {
-									i++
-									token.WriteRune(runes[i])
-								}
-							}
-						}
-					case '>':
-						i++
-						token.WriteRune(runes[i])
-					}
+		case r == '\n':
+			flushToken(i)
+			tokens = append(tokens, Token{Type: TokenNewline, Value: "\n"})
+			i++
+			if len(hereDocs) > 0 {
+				var err error
+				if i, err = readHereDocs(runes, i, tokens, hereDocs); err != nil {
+					return tokens, err
 				}
-				flushToken()
-				i++
+				hereDocs = nil
+			}
 
-			case '<':
-				if _, err := strconv.Atoi(token.String()); err != nil {
-					flushToken()
-				}
-				token.WriteRune('<')
+		case unicode.IsSpace(r):
+			flushToken(i)
+			i++
 
-				if i+1 < len(runes) {
-					switch runes[i+1] {
-					case '>':
-						i++
-						token.WriteRune(runes[i])
+		case r == '#' && word == nil:
+			// a comment runs to the end of the line
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
 
-					case '&':
-						i++
-						token.WriteRune('&')
-
-						if i+1 < len(runes) {
-							if runes[i+1] == '-' {
-								i++
-								token.WriteRune(runes[i])
-							} else {
-								for i+1 < len(runes) && unicode.IsDigit(runes[i+1]) {
-									i++
-									token.WriteRune(runes[i])
-								}
-							}
-						}
-
-					case '<':
-						i++
-						token.WriteRune(runes[i])
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return tokens, ErrUnexpectedEnd
+			}
+			if runes[i+1] == '\n' {
+				i += 2
+				continue
+			}
+			startWord(i)
+			word.addPart(string(runes[i+1]), SingleQuoted)
+			i += 2
+
+		case r == '|':
+			flushToken(i)
+			if i+1 < len(runes) && runes[i+1] == '|' {
+				tokens = append(tokens, Token{Type: TokenOr, Value: "||"})
+				i += 2
+			} else if i+1 < len(runes) && runes[i+1] == '&' {
+				tokens = append(tokens, Token{Type: TokenPipeAll, Value: "|&"})
+				i += 2
+			} else {
+				tokens = append(tokens, Token{Type: TokenPipe, Value: "|"})
+				i++
+			}
 
-						if i+1 < len(runes) && (runes[i+1] == '-' || runes[i+1] == '<') {
-							i++
-							token.WriteRune(runes[i])
-						}
+		case r == '&':
+			flushToken(i)
+			if strings.HasPrefix(string(runes[i:]), "&>>") {
+				tokens = append(tokens, Token{Type: TokenRedirect, Value: "&>>"})
+				i += 3
+			} else if i+1 < len(runes) && runes[i+1] == '>' {
+				tokens = append(tokens, Token{Type: TokenRedirect, Value: "&>"})
+				i += 2
+			} else if i+1 < len(runes) && runes[i+1] == '&' {
+				tokens = append(tokens, Token{Type: TokenAnd, Value: "&&"})
+				i += 2
+			} else {
+				tokens = append(tokens, Token{Type: TokenBackground, Value: "&"})
+				i++
+			}
 
-					}
-				}
-				flushToken()
+		case r == ';':
+			flushToken(i)
+			switch {
+			case strings.HasPrefix(string(runes[i:]), ";;&"):
+				tokens = append(tokens, Token{Type: TokenDoubleSemicolonAnd, Value: ";;&"})
+				i += 3
+			case strings.HasPrefix(string(runes[i:]), ";;"):
+				tokens = append(tokens, Token{Type: TokenDoubleSemicolon, Value: ";;"})
+				i += 2
+			case strings.HasPrefix(string(runes[i:]), ";&"):
+				tokens = append(tokens, Token{Type: TokenSemicolonAnd, Value: ";&"})
+				i += 2
+			default:
+				tokens = append(tokens, Token{Type: TokenSemicolon, Value: ";"})
 				i++
+			}
 
-			case '\\':
-				if i+1 < len(runes) {
-					next := runes[i+1]
-					token.WriteRune(next)
+		case (r == '<' || r == '>') && i+1 < len(runes) && runes[i+1] == '(':
+			end := skipExpansion(i)
+			if end < 0 {
+				return tokens, ErrUnexpectedEnd
+			}
+			startWord(i)
+			word.addPart(string(runes[i:end+1]), Unquoted)
+			i = end + 1
+
+		case r == '>':
+			var op strings.Builder
+			op.WriteString(takeFD(i))
+			op.WriteRune('>')
+
+			if i+1 < len(runes) {
+				switch runes[i+1] {
+				case '&':
 					i++
-				} else {
-					return tokens, ErrUnexpectedEnd
+					op.WriteRune('&')
+					i = dupTarget(i, &op)
+				case '>', '|':
+					i++
+					op.WriteRune(runes[i])
 				}
-			default:
-				token.WriteRune(r)
 			}
+			tokens = append(tokens, Token{Type: TokenRedirect, Value: op.String()})
+			i++
+
+		case r == '<':
+			var op strings.Builder
+			op.WriteString(takeFD(i))
+			op.WriteRune('<')
 
-		} else { //inside quote
-			if r == '\\' {
-				if currentQuote == '"' {
-					if i+1 < len(runes) {
+			if i+1 < len(runes) {
+				switch runes[i+1] {
+				case '>':
+					i++
+					op.WriteRune('>')
+				case '&':
+					i++
+					op.WriteRune('&')
+					i = dupTarget(i, &op)
+				case '<':
+					i++
+					op.WriteRune('<')
+					if i+1 < len(runes) && (runes[i+1] == '-' || runes[i+1] == '<') {
 						i++
-						next := runes[i]
-						switch next {
-						case '\n':
-							token.WriteRune('\n')
-						case '\\':
-							token.WriteRune('\\')
-						case '$':
-							token.WriteRune('$')
-						case '"':
-							token.WriteRune('"')
-						default:
-							token.WriteRune('\\')
-							token.WriteRune(next)
-						}
-					} else {
-						return tokens, ErrUnexpectedEnd
+						op.WriteRune(runes[i])
 					}
-				} else if currentQuote == '\'' {
-					token.WriteRune('\\')
 				}
+			}
+			value := op.String()
+			if operator := strings.TrimLeft(value, "0123456789"); operator == "<<" || operator == "<<-" {
+				hereDocs = append(hereDocs, len(tokens))
+			}
+			tokens = append(tokens, Token{Type: TokenRedirect, Value: value})
+			i++
+
+		case r == '(' && word == nil && i+1 < len(runes) && runes[i+1] == '(':
+			text := string(runes[i:])
+			end := matchingClose(text, 0)
+			if end < 0 {
+				return tokens, ErrUnexpectedEnd
+			}
+			if matchingClose(text, 1) != end-1 {
+				tokens = append(tokens, Token{Type: TokenLParen, Value: "("})
 				i++
-			} else {
-				token.WriteRune(r)
-				i++
+				continue
 			}
+			tokens = append(tokens, Token{Type: TokenArithCommand, Value: text[2 : end-1]})
+			i += utf8.RuneCountInString(text[:end]) + 1
+
+		case r == '(':
+			flushToken(i)
+			tokens = append(tokens, Token{Type: TokenLParen, Value: "("})
+			i++
+
+		case r == ')':
+			flushToken(i)
+			tokens = append(tokens, Token{Type: TokenRParen, Value: ")"})
+			i++
+
+		case isExpansionStart(i):
+			end := skipExpansion(i)
+			if end < 0 {
+				return tokens, ErrUnexpectedEnd
+			}
+			startWord(i)
+			word.addPart(string(runes[i:end+1]), Unquoted)
+			i = end + 1
+
+		default:
+			startWord(i)
+			word.addPart(string(r), Unquoted)
+			i++
 		}
 	}
-	flushToken()
-	if currentQuote != 0 {
+	if currentQuote != 0 || extglobDepth > 0 {
+		return tokens, ErrUnexpectedEnd
+	}
+	flushToken(len(runes))
+	if len(hereDocs) > 0 {
+		// without a delimiter no amount of input completes the document
+		for _, idx := range hereDocs {
+			if idx+1 >= len(tokens) {
+				return tokens, syntaxError(&Token{Type: TokenNewline})
+			}
+			if tokens[idx+1].Type != TokenWord {
+				return tokens, syntaxError(&tokens[idx+1])
+			}
+		}
 		return tokens, ErrUnexpectedEnd
 	}
 	return tokens, nil
 }
 
-type ParsedCommand struct {
-	Name         string
-	Args         []string
-	Redirections []Redirection
-	isBackground bool
-}
+// readHereDocs reads the bodies of the here-documents started by the
+// tokens at hereDocs, one after the other from the line starting at
+// runes[i], and returns the index just past the last delimiter line.
+func readHereDocs(runes []rune, i int, tokens []Token, hereDocs []int) (int, error) {
+	for _, idx := range hereDocs {
+		// a missing delimiter is reported by the parser
+		if idx+1 >= len(tokens) || tokens[idx+1].Type != TokenWord {
+			continue
+		}
+		delimiter := tokens[idx+1].Word.Literal()
+		stripTabs := strings.HasSuffix(tokens[idx].Value, "-")
 
-type ParsedInputSequence struct {
-	ParsedCommands []ParsedCommand
-	Operators      []string
+		var body strings.Builder
+		for {
+			if i >= len(runes) {
+				return i, ErrUnexpectedEnd
+			}
+			end := i
+			for end < len(runes) && runes[end] != '\n' {
+				end++
+			}
+			line := string(runes[i:end])
+			if stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			i = end + 1
+			if line == delimiter {
+				break
+			}
+			body.WriteString(line)
+			body.WriteString("\n")
+		}
+		tokens[idx].Here = body.String()
+	}
+	return min(i, len(runes)), nil
 }
 
-var redirectAttemptRe = regexp.MustCompile(`^(\d+)?(>|<)`)
-var redirectionRe = regexp.MustCompile(`^(\d+)?(>>|<<-?|<<<|<&-?|>&-?|>|<|<>)(\d+)?`)
+var redirectionRe = regexp.MustCompile(`^(\d+)?(&>>|&>|>>|>&-?|>\||>|<<<|<<-?|<&-?|<>|<)(\d+)?$`)
+
+type parser struct {
+	shell  *Shell
+	tokens []Token
+	pos    int
+}
 
-func (s *Shell) ParseInput(command string) (*ParsedInputSequence, error) {
+// ParseInput parses a complete command line into a CommandList. It returns
+// ErrUnexpectedEnd when the input stops in the middle of a construct, so the
+// caller can read a continuation line and try again.
+func (s *Shell) ParseInput(command string) (*CommandList, error) {
 	tokens, err := tokenize(command)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Fprintf(s.term,"%#v\n", tokens)
 
-	sequence := &ParsedInputSequence{
-		ParsedCommands: []ParsedCommand{},
-		Operators:      []string{},
+	p := &parser{shell: s, tokens: tokens}
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
 	}
+	if tok := p.peek(); tok != nil {
+		return nil, syntaxError(tok)
+	}
+	return list, nil
+}
 
-	parsedCmd := ParsedCommand{}
-	i := 0
-	for i < len(tokens) {
-		token := tokens[i]
+func syntaxError(tok *Token) error {
+	if tok.Type == TokenNewline {
+		return errors.New("syntax error near unexpected token `newline'")
+	}
+	return fmt.Errorf("syntax error near unexpected token `%s'", tok.Value)
+}
 
-		switch token {
-		case "&":
-			parsedCmd.isBackground = true
+// listTerminators are the reserved words that end the list inside a
+// compound command.
+var listTerminators = map[string]bool{
+	"then": true,
+	"elif": true,
+	"else": true,
+	"fi":   true,
+	"do":   true,
+	"done": true,
+	"esac": true,
+	"}":    true,
+}
 
-		case "|", "|&", "&&", "||", ";":
-			if parsedCmd.Name == "" && len(parsedCmd.Redirections) == 0 {
-				return nil, fmt.Errorf("%s without preceding command", token)
-			}
-			sequence.ParsedCommands = append(sequence.ParsedCommands, parsedCmd)
-			sequence.Operators = append(sequence.Operators, token)
+func (p *parser) peek() *Token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *parser) next() *Token {
+	tok := p.peek()
+	if tok != nil {
+		p.pos++
+	}
+	return tok
+}
+
+// atReserved reports whether the next token is the reserved word. Reserved
+// words are only recognised unquoted.
+func (p *parser) atReserved(word string) bool {
+	tok := p.peek()
+	return tok != nil && tok.Type == TokenWord && !tok.Word.IsQuoted() && tok.Value == word
+}
+
+func (p *parser) expectReserved(word string) error {
+	if p.atReserved(word) {
+		p.pos++
+		return nil
+	}
+	if tok := p.peek(); tok != nil {
+		return syntaxError(tok)
+	}
+	return ErrUnexpectedEnd
+}
 
-			parsedCmd = ParsedCommand{}
+func (p *parser) skipNewlines() {
+	for tok := p.peek(); tok != nil && tok.Type == TokenNewline; tok = p.peek() {
+		p.pos++
+	}
+}
+
+func (p *parser) atCommandStart() bool {
+	tok := p.peek()
+	if tok == nil {
+		return false
+	}
+	switch tok.Type {
+	case TokenWord:
+		return tok.Word.IsQuoted() || !listTerminators[tok.Value]
+	case TokenRedirect, TokenArithCommand, TokenLParen:
+		return true
+	}
+	return false
+}
+
+// parseList parses and-or lists separated by ;, & and newlines, stopping
+// at the first token that cannot start a command.
+func (p *parser) parseList() (*CommandList, error) {
+	list := &CommandList{}
+	p.skipNewlines()
+	for p.atCommandStart() {
+		andOr, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		item := &ListItem{AndOr: andOr}
+		list.Items = append(list.Items, item)
 
+		tok := p.peek()
+		if tok == nil {
+			break
+		}
+		switch tok.Type {
+		case TokenBackground:
+			item.Background = true
+			p.pos++
+		case TokenSemicolon, TokenNewline:
+			p.pos++
 		default:
-			if matches := redirectionRe.FindStringSubmatch(token); matches != nil {
-				var nextToken string
-				// next token == "" if dont need next token
-				if matches[3] != "" || matches[2] == ">&-" || matches[2] == "<&-" {
-					nextToken = ""
-				} else {
-					if i+1 >= len(tokens) {
-						return nil, fmt.Errorf("syntax error: unexpected token `newline` after %s", token)
-					}
+			return list, nil
+		}
+		p.skipNewlines()
+	}
+	return list, nil
+}
 
-					if isOperator(tokens[i+1]) {
-						return nil, fmt.Errorf("syntax error: unexpected token `%s` after %s", nextToken, matches[2])
-					}
-					nextToken = tokens[i+1]
-					i++
-				}
+// parseCompoundList parses the list inside a compound command, which must
+// not be empty.
+func (p *parser) parseCompoundList() (*CommandList, error) {
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		if tok := p.peek(); tok != nil {
+			return nil, syntaxError(tok)
+		}
+		return nil, ErrUnexpectedEnd
+	}
+	return list, nil
+}
 
-				redirection, err := s.getRedirection(matches, nextToken)
-				if err != nil {
-					return nil, err
-				}
-				parsedCmd.Redirections = append(parsedCmd.Redirections, redirection)
+func (p *parser) parseAndOr() (*AndOrList, error) {
+	pipeline, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	andOr := &AndOrList{Pipelines: []*PipeSequence{pipeline}}
 
-			} else {
-				if parsedCmd.Name == "" {
-					parsedCmd.Name = token
-				} else {
-					parsedCmd.Args = append(parsedCmd.Args, token)
-				}
-			}
+	for tok := p.peek(); tok != nil && (tok.Type == TokenAnd || tok.Type == TokenOr); tok = p.peek() {
+		p.pos++
+		p.skipNewlines()
+		if p.peek() == nil {
+			return nil, ErrUnexpectedEnd
+		}
+		pipeline, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Operators = append(andOr.Operators, tok.Type)
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+	}
+	return andOr, nil
+}
+
+// parsePipeline parses commands joined by | and |&, each ! before them
+// inverting the status of the whole pipeline.
+func (p *parser) parsePipeline() (*PipeSequence, error) {
+	negated := false
+	for p.atReserved("!") {
+		p.pos++
+		negated = !negated
+	}
+	cmd, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	pipeline := &PipeSequence{Commands: []Node{cmd}, Negated: negated}
+
+	for tok := p.peek(); tok != nil && (tok.Type == TokenPipe || tok.Type == TokenPipeAll); tok = p.peek() {
+		p.pos++
+		p.skipNewlines()
+		if p.peek() == nil {
+			return nil, ErrUnexpectedEnd
+		}
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
 		}
-		i++
+		pipeline.PipeStderr = append(pipeline.PipeStderr, tok.Type == TokenPipeAll)
+		pipeline.Commands = append(pipeline.Commands, cmd)
 	}
+	return pipeline, nil
+}
 
-	if parsedCmd.Name != "" || len(parsedCmd.Redirections) > 0 {
-		sequence.ParsedCommands = append(sequence.ParsedCommands, parsedCmd)
+func (p *parser) parseCommand() (Node, error) {
+	if !p.atCommandStart() {
+		if tok := p.peek(); tok != nil {
+			return nil, syntaxError(tok)
+		}
+		return nil, ErrUnexpectedEnd
 	}
 
-	if len(sequence.Operators) != len(sequence.ParsedCommands)-1 {
+	if tok := p.peek(); tok.Type == TokenArithCommand {
+		p.pos++
+		return p.parseCompoundRedirections(&ArithCommand{Expr: tok.Value})
+	}
+	if tok := p.peek(); tok.Type == TokenLParen {
+		p.pos++
+		subshell, err := p.parseSubshell()
+		if err != nil {
+			return nil, err
+		}
+		return p.parseCompoundRedirections(subshell)
+	}
+	if p.atFunctionDefinition() {
+		name := p.next().Value
+		p.pos += 2
+		return p.parseFunctionBody(name)
+	}
+
+	var body Node
+	var err error
+	switch {
+	case p.atReserved("if"):
+		p.pos++
+		body, err = p.parseIf()
+	case p.atReserved("for"):
+		p.pos++
+		body, err = p.parseFor()
+	case p.atReserved("{"):
+		p.pos++
+		body, err = p.parseBraceGroup()
+	case p.atReserved("function"):
+		p.pos++
+		return p.parseFunction()
+	case p.atReserved("case"):
+		p.pos++
+		body, err = p.parseCase()
+	case p.atReserved("while"), p.atReserved("until"):
+		until := p.next().Value == "until"
+		body, err = p.parseWhile(until)
+	default:
+		return p.parseSimpleCommand()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.parseCompoundRedirections(body)
+}
+
+// parseIf parses an if command after the if.
+func (p *parser) parseIf() (*IfClause, error) {
+	clause := &IfClause{}
+	for {
+		condition, err := p.parseCompoundList()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectReserved("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.parseCompoundList()
+		if err != nil {
+			return nil, err
+		}
+		clause.Conditions = append(clause.Conditions, condition)
+		clause.Bodies = append(clause.Bodies, body)
+
+		if !p.atReserved("elif") {
+			break
+		}
+		p.pos++
+	}
+
+	if p.atReserved("else") {
+		p.pos++
+		body, err := p.parseCompoundList()
+		if err != nil {
+			return nil, err
+		}
+		clause.Else = body
+	}
+	if err := p.expectReserved("fi"); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseFor parses a for loop after the for, in either the for name [in
+// words] form or the arithmetic for ((...)) form.
+func (p *parser) parseFor() (Node, error) {
+	tok := p.next()
+	if tok == nil {
 		return nil, ErrUnexpectedEnd
 	}
 
-	return sequence, nil
+	if tok.Type == TokenArithCommand {
+		exprs := strings.Split(tok.Value, ";")
+		if len(exprs) != 3 {
+			return nil, fmt.Errorf("syntax error: arithmetic expression required")
+		}
+		p.skipSeparator()
+		body, err := p.parseDoGroup()
+		if err != nil {
+			return nil, err
+		}
+		return &ArithForClause{
+			Init:      strings.TrimSpace(exprs[0]),
+			Condition: strings.TrimSpace(exprs[1]),
+			Update:    strings.TrimSpace(exprs[2]),
+			Body:      body,
+		}, nil
+	}
+
+	if tok.Type != TokenWord || tok.Word.IsQuoted() || !isName(tok.Value) {
+		return nil, fmt.Errorf("`%s': not a valid identifier", tok.Value)
+	}
+	clause := &ForClause{Name: tok.Value}
+
+	p.skipNewlines()
+	if p.atReserved("in") {
+		p.pos++
+		clause.Words = []*Word{}
+		for tok := p.peek(); tok != nil && tok.Type == TokenWord; tok = p.peek() {
+			p.pos++
+			clause.Words = append(clause.Words, tok.Word)
+		}
+		tok := p.peek()
+		if tok == nil {
+			return nil, ErrUnexpectedEnd
+		}
+		if tok.Type != TokenSemicolon && tok.Type != TokenNewline {
+			return nil, syntaxError(tok)
+		}
+	}
+	p.skipSeparator()
+
+	body, err := p.parseDoGroup()
+	if err != nil {
+		return nil, err
+	}
+	clause.Body = body
+	return clause, nil
 }
 
-func isOperator(token string) bool {
-	switch token {
-	case "|", "|&", "&&", "||", ";", "&":
-		return true
-	default:
+// parseWhile parses a while or until loop after the keyword.
+func (p *parser) parseWhile(until bool) (*WhileClause, error) {
+	condition, err := p.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseDoGroup()
+	if err != nil {
+		return nil, err
+	}
+	return &WhileClause{Condition: condition, Body: body, Until: until}, nil
+}
+
+// parseDoGroup parses the do list done body of a loop.
+func (p *parser) parseDoGroup() (*CommandList, error) {
+	if err := p.expectReserved("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectReserved("done"); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// skipSeparator skips an optional ; and any newlines, as allowed before
+// the do of a for loop.
+func (p *parser) skipSeparator() {
+	if tok := p.peek(); tok != nil && tok.Type == TokenSemicolon {
+		p.pos++
+	}
+	p.skipNewlines()
+}
+
+// parseSubshell parses a ( list ) after the (.
+func (p *parser) parseSubshell() (*Subshell, error) {
+	body, err := p.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.next()
+	if tok == nil {
+		return nil, ErrUnexpectedEnd
+	}
+	if tok.Type != TokenRParen {
+		return nil, syntaxError(tok)
+	}
+	return &Subshell{Body: body}, nil
+}
+
+// parseBraceGroup parses a { list; } group after the {.
+func (p *parser) parseBraceGroup() (*BraceGroup, error) {
+	body, err := p.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectReserved("}"); err != nil {
+		return nil, err
+	}
+	return &BraceGroup{Body: body}, nil
+}
+
+// atFunctionDefinition reports whether the next tokens are the name ( )
+// that start a function definition.
+func (p *parser) atFunctionDefinition() bool {
+	if p.pos+2 >= len(p.tokens) {
 		return false
 	}
+	tok := p.tokens[p.pos]
+	return tok.Type == TokenWord && isFunctionName(tok.Word) &&
+		p.tokens[p.pos+1].Type == TokenLParen && p.tokens[p.pos+2].Type == TokenRParen
+}
+
+// isFunctionName reports whether w can name a function: it must be
+// unquoted and cannot be an assignment or contain expansions.
+func isFunctionName(w *Word) bool {
+	return !w.IsQuoted() && !isAssignment(w) && !strings.ContainsAny(w.Raw, "$`")
+}
+
+// parseFunction parses a function definition after the function keyword,
+// in which the () after the name is optional.
+func (p *parser) parseFunction() (Node, error) {
+	tok := p.next()
+	if tok == nil {
+		return nil, ErrUnexpectedEnd
+	}
+	if tok.Type != TokenWord || !isFunctionName(tok.Word) {
+		return nil, syntaxError(tok)
+	}
+	if next := p.peek(); next != nil && next.Type == TokenLParen {
+		p.pos++
+		if next := p.next(); next == nil {
+			return nil, ErrUnexpectedEnd
+		} else if next.Type != TokenRParen {
+			return nil, syntaxError(next)
+		}
+	}
+	return p.parseFunctionBody(tok.Value)
+}
+
+// parseFunctionBody parses the compound command, with its redirections,
+// that forms the body of the function name.
+func (p *parser) parseFunctionBody(name string) (Node, error) {
+	p.skipNewlines()
+	if p.peek() == nil {
+		return nil, ErrUnexpectedEnd
+	}
+	start := p.peek()
+	body, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	compound, ok := body.(*CompoundCommand)
+	if !ok {
+		return nil, syntaxError(start)
+	}
+	return &FunctionDef{Name: name, Body: compound}, nil
 }
 
-func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection, error) {
+// parseCase parses a case command after the case.
+func (p *parser) parseCase() (*CaseClause, error) {
+	tok := p.next()
+	if tok == nil {
+		return nil, ErrUnexpectedEnd
+	}
+	if tok.Type != TokenWord {
+		return nil, syntaxError(tok)
+	}
+	clause := &CaseClause{Word: tok.Word}
+
+	p.skipNewlines()
+	if err := p.expectReserved("in"); err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+	for !p.atReserved("esac") {
+		item, err := p.parseCaseItem()
+		if err != nil {
+			return nil, err
+		}
+		clause.Items = append(clause.Items, item)
+	}
+	p.pos++
+	return clause, nil
+}
+
+// parseCaseItem parses one [(]pattern[|pattern]...) list item of a case
+// command together with the operator that ends it, which may only be left
+// out before the esac.
+func (p *parser) parseCaseItem() (*CaseItem, error) {
+	if tok := p.peek(); tok != nil && tok.Type == TokenLParen {
+		p.pos++
+	}
+
+	item := &CaseItem{Terminator: TokenDoubleSemicolon}
+	for {
+		tok := p.next()
+		if tok == nil {
+			return nil, ErrUnexpectedEnd
+		}
+		if tok.Type != TokenWord {
+			return nil, syntaxError(tok)
+		}
+		item.Patterns = append(item.Patterns, tok.Word)
+
+		tok = p.next()
+		if tok == nil {
+			return nil, ErrUnexpectedEnd
+		}
+		if tok.Type == TokenRParen {
+			break
+		}
+		if tok.Type != TokenPipe {
+			return nil, syntaxError(tok)
+		}
+	}
+
+	body, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	item.Body = body
+
+	tok := p.peek()
+	if tok == nil {
+		return nil, ErrUnexpectedEnd
+	}
+	switch tok.Type {
+	case TokenDoubleSemicolon, TokenSemicolonAnd, TokenDoubleSemicolonAnd:
+		item.Terminator = tok.Type
+		p.pos++
+		p.skipNewlines()
+	default:
+		if !p.atReserved("esac") {
+			return nil, syntaxError(tok)
+		}
+	}
+	return item, nil
+}
+
+// parseCompoundRedirections collects the redirections that follow a
+// compound command and apply to all of it.
+func (p *parser) parseCompoundRedirections(body Node) (Node, error) {
+	cmd := &CompoundCommand{Body: body}
+	for tok := p.peek(); tok != nil && tok.Type == TokenRedirect; tok = p.peek() {
+		p.pos++
+		redirection, err := p.parseRedirection(tok)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Redirections = append(cmd.Redirections, redirection)
+	}
+	if tok := p.peek(); tok != nil && (tok.Type == TokenWord || tok.Type == TokenArithCommand || tok.Type == TokenLParen) {
+		return nil, syntaxError(tok)
+	}
+	return cmd, nil
+}
+
+var assignmentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// isAssignment reports whether w has the NAME=value form, with the name and
+// equals sign unquoted.
+func isAssignment(w *Word) bool {
+	return len(w.Parts) > 0 && w.Parts[0].Quote == Unquoted && assignmentRe.MatchString(w.Parts[0].Text)
+}
+
+func (p *parser) parseSimpleCommand() (*SimpleCommand, error) {
+	cmd := &SimpleCommand{}
+	for tok := p.peek(); tok != nil && (tok.Type == TokenWord || tok.Type == TokenRedirect); tok = p.peek() {
+		p.pos++
+		if tok.Type == TokenRedirect {
+			redirection, err := p.parseRedirection(tok)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Redirections = append(cmd.Redirections, redirection)
+			continue
+		}
+
+		if len(cmd.Words) == 0 && isAssignment(tok.Word) {
+			cmd.Assignments = append(cmd.Assignments, tok.Word)
+		} else {
+			cmd.Words = append(cmd.Words, tok.Word)
+		}
+	}
+	return cmd, nil
+}
+
+func (p *parser) parseRedirection(tok *Token) (Redirection, error) {
+	matches := redirectionRe.FindStringSubmatch(tok.Value)
+	if matches == nil {
+		return nil, syntaxError(tok)
+	}
+
+	var operand *Word
+	// the operand is glued to the operator for >&N, <&N and the closers
+	if matches[3] == "" && matches[2] != ">&-" && matches[2] != "<&-" {
+		next := p.next()
+		if next == nil {
+			return nil, fmt.Errorf("syntax error near unexpected token `newline'")
+		}
+		if next.Type != TokenWord {
+			return nil, syntaxError(next)
+		}
+		operand = next.Word
+	}
+
+	return getRedirection(matches, operand, tok.Here)
+}
+
+// getRedirection builds the redirection for an operator matched by
+// redirectionRe, where here is the body of a here-document.
+func getRedirection(matches []string, operand *Word, here string) (Redirection, error) {
 	// matches[0] full
 	// matches[2] Operator
 	// matches[1] source, matches[3] Destination
 	op := matches[2]
 
 	switch op {
-	case ">", ">>":
+	case ">", ">|", ">>", "&>", "&>>":
 		sourceFD := 1
 		if matches[1] != "" {
 			fd, _ := strconv.Atoi(matches[1])
@@ -311,7 +1121,7 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 		return &OutputRedirection{
 			Operator:   op,
 			SourceFD:   sourceFD,
-			TargetFile: nextToken,
+			TargetFile: operand,
 			TargetFD:   nil,
 		}, nil
 
@@ -322,12 +1132,21 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 			sourceFD = fd
 		}
 
+		// without a number the operand word is expanded to find the
+		// descriptor, a - or a file name
+		if matches[3] == "" {
+			return &OutputRedirection{
+				Operator:   op,
+				SourceFD:   sourceFD,
+				TargetFile: operand,
+			}, nil
+		}
 		targetFD, _ := strconv.Atoi(matches[3])
 
 		return &OutputRedirection{
 			Operator:   op,
 			SourceFD:   sourceFD,
-			TargetFile: "",
+			TargetFile: nil,
 			TargetFD:   &targetFD,
 		}, nil
 
@@ -355,7 +1174,7 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 			TargetFD: targetFD,
 		}, nil
 
-	case "<":
+	case "<", "<>":
 		targetFD := 0
 		if matches[1] != "" {
 			targetFD, _ = strconv.Atoi(matches[1])
@@ -364,7 +1183,7 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 		return &InputRedirection{
 			Operator:   op,
 			TargetFD:   targetFD,
-			SourceFile: nextToken,
+			SourceFile: operand,
 			SourceFD:   nil,
 		}, nil
 
@@ -374,11 +1193,18 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 			targetFD, _ = strconv.Atoi(matches[1])
 		}
 
-		sourceFD, _ := strconv.Atoi(nextToken)
+		if matches[3] == "" {
+			return &InputRedirection{
+				Operator:   op,
+				TargetFD:   targetFD,
+				SourceFile: operand,
+			}, nil
+		}
+		sourceFD, _ := strconv.Atoi(matches[3])
 		return &InputRedirection{
 			Operator:   op,
 			TargetFD:   targetFD,
-			SourceFile: "",
+			SourceFile: nil,
 			SourceFD:   &sourceFD,
 		}, nil
 
@@ -388,27 +1214,12 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 			targetFD, _ = strconv.Atoi(matches[1])
 		}
 
-		delimiter := nextToken
-		var content strings.Builder
-		s.term.SetPrompt(promptNextLine)
-		for {
-			line, err := s.term.ReadLine()
-			if err != nil {
-				return nil, fmt.Errorf("Error reading line '%s'", delimiter)
-			}
-
-			if line == delimiter {
-				break
-			}
-			content.WriteString(line)
-			content.WriteString("\n")
-		}
-		s.term.SetPrompt(promptDefault)
-
 		return &HereRedirection{
-			Operator: op,
-			TargetFD: targetFD,
-			Content:  content.String(),
+			Operator:  op,
+			TargetFD:  targetFD,
+			Delimiter: operand.Literal(),
+			Content:   here,
+			Expand:    !operand.IsQuoted(),
 		}, nil
 
 	case "<<<":
@@ -417,11 +1228,10 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 			targetFD, _ = strconv.Atoi(matches[1])
 		}
 
-		content := nextToken
 		return &HereRedirection{
 			Operator: op,
 			TargetFD: targetFD,
-			Content:  content,
+			Word:     operand,
 		}, nil
 
 	default:
@@ -431,26 +1241,41 @@ func (s *Shell) getRedirection(matches []string, nextToken string) (Redirection,
 
 type Redirection interface {
 	GetType() string
+	String() string
 }
 
 type OutputRedirection struct {
 	Operator   string
 	SourceFD   int
-	TargetFile string
+	TargetFile *Word
 	TargetFD   *int
 }
 
 func (r *OutputRedirection) GetType() string { return "output" }
 
+func (r *OutputRedirection) String() string {
+	if r.TargetFD != nil {
+		return fdPrefix(r.SourceFD, 1) + r.Operator + strconv.Itoa(*r.TargetFD)
+	}
+	return fdPrefix(r.SourceFD, 1) + r.Operator + " " + r.TargetFile.String()
+}
+
 type InputRedirection struct {
 	Operator   string
 	TargetFD   int
-	SourceFile string
+	SourceFile *Word
 	SourceFD   *int
 }
 
 func (r *InputRedirection) GetType() string { return "input" }
 
+func (r *InputRedirection) String() string {
+	if r.SourceFD != nil {
+		return fdPrefix(r.TargetFD, 0) + r.Operator + strconv.Itoa(*r.SourceFD)
+	}
+	return fdPrefix(r.TargetFD, 0) + r.Operator + " " + r.SourceFile.String()
+}
+
 type RedirectionCloser struct {
 	Operator string
 	TargetFD int
@@ -458,10 +1283,55 @@ type RedirectionCloser struct {
 
 func (r *RedirectionCloser) GetType() string { return "closer" }
 
+func (r *RedirectionCloser) String() string {
+	if r.Operator == "<&-" {
+		return fdPrefix(r.TargetFD, 0) + r.Operator
+	}
+	return fdPrefix(r.TargetFD, 1) + r.Operator
+}
+
 type HereRedirection struct {
-	Operator string
-	TargetFD int
-	Content  string
+	Operator  string
+	TargetFD  int
+	Delimiter string
+	Content   string
+	// Expand is set when the delimiter was unquoted, so the content is
+	// subject to expansion.
+	Expand bool
+	// Word is the operand of a <<< here-string.
+	Word *Word
 }
 
 func (r *HereRedirection) GetType() string { return "here" }
+
+func (r *HereRedirection) String() string {
+	if r.Operator == "<<<" {
+		return fdPrefix(r.TargetFD, 0) + r.Operator + " " + r.Word.String()
+	}
+	delimiter := r.Delimiter
+	if !r.Expand {
+		delimiter = shellQuote(delimiter)
+		if delimiter == r.Delimiter {
+			delimiter = "'" + delimiter + "'"
+		}
+	}
+	return fdPrefix(r.TargetFD, 0) + r.Operator + " " + delimiter
+}
+
+// Document returns the body of a here-document followed by its delimiter
+// line, as it follows the command line. A here-string has none.
+func (r *HereRedirection) Document() string {
+	if r.Operator == "<<<" {
+		return ""
+	}
+	return r.Content + r.Delimiter + "\n"
+}
+
+// fdPrefix returns the explicit descriptor number to print before a
+// redirection operator, or "" when fd is the operator's default.
+func fdPrefix(fd, defaultFD int) string {
+	if fd == defaultFD {
+		return ""
+	}
+	return strconv.Itoa(fd)
+}
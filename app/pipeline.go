@@ -2,48 +2,406 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"os"
+	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 )
 
+// ProcessGroup is the process group of a job. Each of its processes is
+// watched with waitid, so that stops and continues are seen as well as
+// exits. A background job also runs commands in the shell itself, which
+// hold the group running until they finish.
 type ProcessGroup struct {
-	pgid int
-	pids []int
-	mu   sync.Mutex
+	pgid  int
+	procs []*process
+	// foreground is set while the job owns the terminal, so that the
+	// processes it starts join the terminal's foreground group.
+	foreground bool
+	// inShell is set while the job runs commands in the shell, and
+	// status is their status once finished.
+	inShell  bool
+	finished bool
+	status   int
+	// stopped records that a process of the group has stopped at some
+	// point, so its status is no longer that of the commands in the
+	// shell.
+	stopped bool
+	// killed is the signal that ended the job while the shell ran
+	// commands for it, which stop at the next one.
+	killed syscall.Signal
+	mu     sync.Mutex
+	// changed is broadcast whenever one of the processes changes state,
+	// and notify, if set, is called after it.
+	changed *sync.Cond
+	notify  func()
+	// startMu is held while a process is started or reaped, so that the
+	// group can't disappear while a new process joins it.
+	startMu sync.Mutex
+}
+
+// process is one process of a ProcessGroup. status is its exit status once
+// completed, or 128 plus the signal that stopped it, and sig that signal
+// or the one that killed it.
+type process struct {
+	pid    int
+	state  JobStatus
+	status int
+	sig    syscall.Signal
 }
 
+// waitid codes for the state change of a child.
+const (
+	cldStopped   = 5
+	cldContinued = 6
+)
+
 func NewProcessGroup() *ProcessGroup {
-	return &ProcessGroup{
-		pgid: -1,
-		pids: make([]int, 0),
+	pg := &ProcessGroup{pgid: -1}
+	pg.changed = sync.NewCond(&pg.mu)
+	return pg
+}
+
+// Start starts cmd in the group, which is created by the first process to
+// start or again once all the earlier ones have finished. tty is the
+// terminal whose foreground group a foreground job takes, or -1.
+func (pg *ProcessGroup) Start(cmd *exec.Cmd, tty int) (*process, error) {
+	pg.startMu.Lock()
+	defer pg.startMu.Unlock()
+
+	pg.mu.Lock()
+	pgid := 0
+	if pg.live() {
+		pgid = pg.pgid
+	}
+	foreground := pg.foreground && tty >= 0
+	pg.mu.Unlock()
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: pgid, Foreground: foreground, Ctty: tty}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &process{pid: cmd.Process.Pid, state: JobRunning}
+	pg.mu.Lock()
+	if pgid == 0 {
+		pg.pgid = p.pid
+	}
+	pg.procs = append(pg.procs, p)
+	pg.changed.Broadcast()
+	pg.mu.Unlock()
+	go pg.watch(cmd, p)
+	return p, nil
+}
+
+// live reports whether any process of the group is yet to be reaped.
+func (pg *ProcessGroup) live() bool {
+	for _, p := range pg.procs {
+		if p.state != JobCompleted {
+			return true
+		}
+	}
+	return false
+}
+
+// watch follows the state of p until it exits. Stops and continues are
+// taken with wait4, while the exit is left for cmd.Wait to collect.
+func (pg *ProcessGroup) watch(cmd *exec.Cmd, p *process) {
+	for {
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_PID, p.pid, &info, unix.WEXITED|unix.WSTOPPED|unix.WCONTINUED|unix.WNOWAIT, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || (info.Code != cldStopped && info.Code != cldContinued) {
+			break
+		}
+
+		var ws unix.WaitStatus
+		if _, err := unix.Wait4(p.pid, &ws, unix.WUNTRACED|unix.WCONTINUED|unix.WNOHANG, nil); err != nil {
+			break
+		}
+		switch {
+		case ws.Stopped():
+			pg.setState(p, JobStopped, 128+int(ws.StopSignal()), syscall.Signal(ws.StopSignal()))
+		case ws.Continued():
+			pg.setState(p, JobRunning, 0, 0)
+		}
 	}
+
+	pg.startMu.Lock()
+	defer pg.startMu.Unlock()
+	cmd.Wait()
+	status, sig := 1, syscall.Signal(0)
+	if cmd.ProcessState != nil {
+		status = exitStatus(cmd.ProcessState)
+		if ws := cmd.ProcessState.Sys().(syscall.WaitStatus); ws.Signaled() {
+			sig = ws.Signal()
+		}
+	}
+	pg.setState(p, JobCompleted, status, sig)
 }
 
-func (pg *ProcessGroup) AddProcess(proc *os.Process) error {
+func (pg *ProcessGroup) setState(p *process, state JobStatus, status int, sig syscall.Signal) {
+	pg.mu.Lock()
+	p.state, p.status, p.sig = state, status, sig
+	if state == JobStopped {
+		pg.stopped = true
+	}
+	pg.changed.Broadcast()
+	notify := pg.notify
+	pg.mu.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+// Wait waits until p exits or stops and returns its status.
+func (pg *ProcessGroup) Wait(p *process) int {
 	pg.mu.Lock()
 	defer pg.mu.Unlock()
 
-	if pg.pgid == -1 {
-		pg.pgid = proc.Pid
-		if err := syscall.Setpgid(proc.Pid, proc.Pid); err != nil {
-			return fmt.Errorf("failed to set process group: %w", err)
+	for p.state == JobRunning {
+		pg.changed.Wait()
+	}
+	return p.status
+}
+
+// Hold marks the group as running commands in the shell, until Finish
+// records their status.
+func (pg *ProcessGroup) Hold() {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.inShell = true
+}
+
+func (pg *ProcessGroup) Finish(status int) {
+	pg.mu.Lock()
+	pg.inShell, pg.finished, pg.status = false, true, status
+	pg.changed.Broadcast()
+	notify := pg.notify
+	pg.mu.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+// SetNotify sets the function called after each change of state.
+func (pg *ProcessGroup) SetNotify(notify func()) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.notify = notify
+}
+
+// State returns JobStopped if any process of the group is stopped,
+// JobRunning while any runs or the shell still runs commands for it, and
+// JobCompleted once all are done.
+func (pg *ProcessGroup) State() JobStatus {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	state := JobCompleted
+	if pg.inShell {
+		state = JobRunning
+	}
+	for _, p := range pg.procs {
+		switch p.state {
+		case JobStopped:
+			return JobStopped
+		case JobRunning:
+			state = JobRunning
+		}
+	}
+	return state
+}
+
+// Result returns the exit status of a completed group, and the signal
+// that killed it if any. That is the status of the commands run in the
+// shell, or that of the last process when the group was stopped on the
+// way, as those commands then went on without it.
+func (pg *ProcessGroup) Result() (int, syscall.Signal) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if pg.killed != 0 && pg.finished {
+		return 128 + int(pg.killed), pg.killed
+	}
+	var last *process
+	if len(pg.procs) > 0 {
+		last = pg.procs[len(pg.procs)-1]
+	}
+	if last == nil || (pg.finished && !pg.stopped) {
+		if last != nil && last.sig != 0 && pg.status == last.status {
+			return pg.status, last.sig
 		}
-	} else {
-		if err := syscall.Setpgid(proc.Pid, pg.pgid); err != nil {
-			return fmt.Errorf("failed to add to process group: %w", err)
+		return pg.status, 0
+	}
+	return last.status, last.sig
+}
+
+// StopSignal returns the signal that stopped a process of the group, or
+// 0 if none is stopped.
+func (pg *ProcessGroup) StopSignal() syscall.Signal {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	for _, p := range pg.procs {
+		if p.state == JobStopped {
+			return p.sig
 		}
 	}
+	return 0
+}
 
-	pg.processes = append(pg.processes, proc)
-	return nil
+// Continue sends SIGCONT to the group, counting its stopped processes as
+// running from then on.
+func (pg *ProcessGroup) Continue() error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	for _, p := range pg.procs {
+		if p.state == JobStopped {
+			p.state, p.status, p.sig = JobRunning, 0, 0
+		}
+	}
+	if pg.pgid == -1 {
+		return nil
+	}
+	return syscall.Kill(-pg.pgid, syscall.SIGCONT)
+}
+
+// Kill sends sig to the group, and also to stopped processes SIGCONT for
+// SIGTERM and SIGHUP to act on. A signal that ends processes also ends the
+// commands the shell runs for the job.
+func (pg *ProcessGroup) Kill(sig syscall.Signal) error {
+	pg.mu.Lock()
+	pgid, stopped := pg.pgid, false
+	for _, p := range pg.procs {
+		stopped = stopped || p.state == JobStopped
+	}
+	if pg.inShell && terminates(sig) {
+		pg.killed = sig
+	}
+	killed := pg.killed
+	pg.mu.Unlock()
+
+	var err error = syscall.ESRCH
+	if pgid != -1 {
+		err = syscall.Kill(-pgid, sig)
+	}
+	if err == syscall.ESRCH && killed != 0 {
+		return nil
+	}
+	if err == nil && stopped && (sig == syscall.SIGTERM || sig == syscall.SIGHUP) {
+		err = syscall.Kill(-pgid, syscall.SIGCONT)
+	}
+	return err
+}
+
+// Killed returns the signal that ended the job while the shell ran
+// commands for it, or 0.
+func (pg *ProcessGroup) Killed() syscall.Signal {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.killed
+}
+
+// Stopped reports whether any process of the group is stopped.
+func (pg *ProcessGroup) Stopped() bool {
+	return pg.State() == JobStopped
+}
+
+// Foreground reports whether the job owns the terminal.
+func (pg *ProcessGroup) Foreground() bool {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.foreground
+}
+
+// Interrupted reports whether any process of the group was killed by
+// SIGINT.
+func (pg *ProcessGroup) Interrupted() bool {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	for _, p := range pg.procs {
+		if p.state == JobCompleted && p.sig == syscall.SIGINT {
+			return true
+		}
+	}
+	return false
+}
+
+// SetForeground records whether the job owns the terminal.
+func (pg *ProcessGroup) SetForeground(foreground bool) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.foreground = foreground
+}
+
+// Pgid returns the id of the process group, or -1 before any process
+// started.
+func (pg *ProcessGroup) Pgid() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.pgid
+}
+
+// PIDs returns the processes started in the group, in order.
+func (pg *ProcessGroup) PIDs() []int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pids := make([]int, len(pg.procs))
+	for i, p := range pg.procs {
+		pids[i] = p.pid
+	}
+	return pids
+}
+
+// LastPID returns the most recently started process, or -1 if there is
+// none.
+func (pg *ProcessGroup) LastPID() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if len(pg.procs) == 0 {
+		return -1
+	}
+	return pg.procs[len(pg.procs)-1].pid
+}
+
+// FirstPID waits until the group starts a process and returns it, or -1
+// when its commands finish without starting one.
+func (pg *ProcessGroup) FirstPID() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	for len(pg.procs) == 0 && pg.inShell {
+		pg.changed.Wait()
+	}
+	if len(pg.procs) == 0 {
+		return -1
+	}
+	return pg.procs[0].pid
 }
 
 func (pg *ProcessGroup) Signal(sig os.Signal) error {
-	pg.mu.RLock()
-	defer pg.mu.RUnlock()
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
 
 	if pg.pgid == -1 {
 		return errors.New("no process group set")
@@ -52,16 +410,38 @@ func (pg *ProcessGroup) Signal(sig os.Signal) error {
 	return syscall.Kill(-pg.pgid, sig.(syscall.Signal))
 }
 
+// exitStatus returns the status of a finished process, 128 plus the signal
+// number for one killed by a signal.
+func exitStatus(state *os.ProcessState) int {
+	ws := state.Sys().(syscall.WaitStatus)
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+// Job is an entry of the job table. Status is the state of the job last
+// reported to the user.
 type Job struct {
 	ID           int
-	Pipeline     *Pipeline
+	Text         string
 	ProcessGroup *ProcessGroup
 	Background   bool
 	Status       JobStatus
 	StartTime    time.Time
-	completed    chan struct{}
+	// seq orders the jobs by when they last started, stopped or went to
+	// the background, for %+ and %-.
+	seq int
+	// inherited marks the copy of a job of the parent shell that a
+	// subshell can list but not wait for.
+	inherited bool
+	// termState holds the terminal modes of a stopped job, to be set
+	// again when it returns to the foreground.
+	termState *term.State
 }
 
+func (j *Job) String() string { return j.Text }
+
 type JobStatus int
 
 const (
@@ -76,4 +456,77 @@ type Pipeline struct {
 	exitCode  int
 	completed chan struct{}
 	err       error
-}
\ No newline at end of file
+}
+
+// NewPipeline creates the stages of seq with a pipe between each pair of
+// neighbours. The first stage reads from cio.Stdin and the last one writes
+// to cio.Stdout.
+func NewPipeline(seq *PipeSequence, cio CommandIO) (*Pipeline, error) {
+	p := &Pipeline{completed: make(chan struct{})}
+	for _, node := range seq.Commands {
+		p.Commands = append(p.Commands, NewCommand(node, cio))
+	}
+
+	for i := 0; i < len(p.Commands)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			p.closePipes()
+			return nil, err
+		}
+
+		left, right := p.Commands[i], p.Commands[i+1]
+		left.Stdout = w
+		if seq.PipeStderr[i] {
+			left.Stderr = w
+		}
+		left.pipeEnds = append(left.pipeEnds, w)
+		right.Stdin = r
+		right.pipeEnds = append(right.pipeEnds, r)
+	}
+	return p, nil
+}
+
+func (p *Pipeline) closePipes() {
+	for _, cmd := range p.Commands {
+		for _, f := range cmd.pipeEnds {
+			f.Close()
+		}
+	}
+}
+
+// Start runs each stage in its own goroutine on a subshell of s. Builtins
+// write straight into the pipe, external commands inherit it.
+func (p *Pipeline) Start(s *Shell) {
+	var wg sync.WaitGroup
+	for _, cmd := range p.Commands {
+		sub := s.subshell()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd.exitCode = sub.executeNode(cmd.Node, CommandIO{Stdin: cmd.Stdin, Stdout: cmd.Stdout, Stderr: cmd.Stderr})
+			for _, f := range cmd.pipeEnds {
+				f.Close()
+			}
+			close(cmd.done)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		p.exitCode = p.Commands[len(p.Commands)-1].exitCode
+		close(p.completed)
+	}()
+}
+
+func (p *Pipeline) Wait() (int, error) {
+	<-p.completed
+	return p.exitCode, p.err
+}
+
+func (p *Pipeline) String() string {
+	parts := make([]string, len(p.Commands))
+	for i, cmd := range p.Commands {
+		parts[i] = cmd.Node.String()
+	}
+	return strings.Join(parts, " | ")
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// RedirectionHandler is a table of open file descriptors by number. The
+// shell keeps one with its standard streams and the descriptors above 2
+// that commands inherit. A nil entry is a closed descriptor.
+type RedirectionHandler struct {
+	fds map[int]*os.File
+}
+
+func NewRedirectionHandler() *RedirectionHandler {
+	return &RedirectionHandler{
+		fds: map[int]*os.File{
+			0: os.Stdin,
+			1: os.Stdout,
+			2: os.Stderr,
+		},
+	}
+}
+
+func (rh *RedirectionHandler) Close() error {
+	var lastErr error
+	for fd, file := range rh.fds {
+		if fd > 2 && file != nil {
+			if err := file.Close(); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+func (rh *RedirectionHandler) GetFD(fd int) *os.File {
+	if file, ok := rh.fds[fd]; ok {
+		return file
+	}
+	return nil
+}
+
+func (rh *RedirectionHandler) SetFD(fd int, file *os.File) {
+	rh.fds[fd] = file
+}
+
+// CloseFD closes the file open on fd and removes it from the table.
+func (rh *RedirectionHandler) CloseFD(fd int) error {
+	file, ok := rh.fds[fd]
+	if !ok || file == nil {
+		return nil
+	}
+	delete(rh.fds, fd)
+	return file.Close()
+}
+
+// Clone returns a table with the same files, which remain owned by rh.
+func (rh *RedirectionHandler) Clone() *RedirectionHandler {
+	return &RedirectionHandler{fds: maps.Clone(rh.fds)}
+}
+
+// ExtraFiles returns the files open above fd 2 laid out for
+// exec.Cmd.ExtraFiles, so that each keeps its number in the child.
+func (rh *RedirectionHandler) ExtraFiles() []*os.File {
+	var files []*os.File
+	for fd, file := range rh.fds {
+		if fd <= 2 || file == nil {
+			continue
+		}
+		for len(files) <= fd-3 {
+			files = append(files, nil)
+		}
+		files[fd-3] = file
+	}
+	return files
+}
+
+// dupFile returns a file on a new descriptor for the same open file as f,
+// which can be closed without affecting f.
+func dupFile(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// detach gives sub descriptors of its own for the files it shares with
+// the command that started it, in cio and in its table, for a command that
+// runs on in the background after redirections around it are undone. The
+// returned function closes them once it has finished.
+func (sub *Shell) detach(cio CommandIO) (CommandIO, func()) {
+	var owned []*os.File
+	own := func(f *os.File) *os.File {
+		// the shell's own streams stay open, and writes to the terminal
+		// go through it
+		if f == os.Stdin || f == os.Stdout || f == os.Stderr {
+			return f
+		}
+		dup, err := dupFile(f)
+		if err != nil {
+			return f
+		}
+		owned = append(owned, dup)
+		return dup
+	}
+
+	if f, ok := cio.Stdin.(*os.File); ok {
+		cio.Stdin = own(f)
+	}
+	if f, ok := cio.Stdout.(*os.File); ok {
+		cio.Stdout = own(f)
+	}
+	if f, ok := cio.Stderr.(*os.File); ok {
+		cio.Stderr = own(f)
+	}
+	fds := NewRedirectionHandler()
+	for fd, file := range sub.fds.fds {
+		if file != nil {
+			file = own(file)
+		}
+		fds.SetFD(fd, file)
+	}
+	sub.fds = fds
+
+	return cio, func() {
+		for _, f := range owned {
+			f.Close()
+		}
+	}
+}
+
+// hereDocPipeMax is the largest here-document passed through a pipe. It
+// is PIPE_BUF, far below the capacity of a pipe, so writing it up front
+// cannot block.
+const hereDocPipeMax = 4096
+
+// hereDocFile returns a file to read content from: a pipe already holding
+// it when it is small, and otherwise an unlinked temporary file, so that a
+// large body never waits for a reader to drain it.
+func hereDocFile(content string) (*os.File, error) {
+	if len(content) <= hereDocPipeMax {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(w, content)
+		w.Close()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+
+	file, err := os.CreateTemp("", "goson-heredoc-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	if _, err := io.WriteString(file, content); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// redirector applies the redirections of one command in order. The
+// standard streams live in cio, since builtins can be given streams that
+// are not files, and descriptors above 2 live in the shell's table so that
+// nested commands and children inherit them. Unless permanent is set, as
+// for exec without a command, undo puts the table back and closes the
+// files that were opened.
+type redirector struct {
+	s         *Shell
+	cio       CommandIO
+	permanent bool
+	// saved holds the entries of the shell's table replaced so far.
+	saved  map[int]*os.File
+	opened []*os.File
+}
+
+// handleRedirections applies redirections for a single command. The
+// returned function undoes them and must be called once the command has
+// finished, even when an error is returned.
+func (s *Shell) handleRedirections(redirections []Redirection, cio CommandIO) (CommandIO, func(), error) {
+	return s.applyRedirections(redirections, cio, false)
+}
+
+func (s *Shell) applyRedirections(redirections []Redirection, cio CommandIO, permanent bool) (CommandIO, func(), error) {
+	r := &redirector{s: s, cio: cio, permanent: permanent, saved: make(map[int]*os.File)}
+	for _, redir := range redirections {
+		if err := r.apply(redir); err != nil {
+			return r.cio, r.undo, err
+		}
+	}
+	return r.cio, r.undo, nil
+}
+
+func (r *redirector) undo() {
+	for fd, file := range r.saved {
+		r.s.fds.SetFD(fd, file)
+	}
+	for _, file := range r.opened {
+		file.Close()
+	}
+}
+
+func (r *redirector) apply(redir Redirection) error {
+	switch rd := redir.(type) {
+	case *OutputRedirection:
+		if rd.TargetFD != nil {
+			return r.dup(rd.SourceFD, *rd.TargetFD)
+		}
+		name, err := r.target(rd.TargetFile)
+		if err != nil {
+			return err
+		}
+
+		op := rd.Operator
+		if op == ">&" {
+			switch {
+			case isAllDigits(name):
+				n, _ := strconv.Atoi(name)
+				return r.dup(rd.SourceFD, n)
+			case name == "-":
+				return r.close(rd.SourceFD)
+			case rd.SourceFD != 1:
+				return fmt.Errorf("%s: ambiguous redirect", rd.TargetFile)
+			}
+			// >&file is the same as &>file
+			op = "&>"
+		}
+
+		var file *os.File
+		switch {
+		case op == ">>" || op == "&>>":
+			file, err = r.open(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+		case op != ">|" && r.s.options["noclobber"]:
+			file, err = r.openNoClobber(name)
+		default:
+			file, err = r.open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		}
+		if err != nil {
+			return err
+		}
+		if op == "&>" || op == "&>>" {
+			if err := r.set(1, file); err != nil {
+				return err
+			}
+			return r.set(2, file)
+		}
+		return r.set(rd.SourceFD, file)
+
+	case *InputRedirection:
+		if rd.SourceFD != nil {
+			return r.dup(rd.TargetFD, *rd.SourceFD)
+		}
+		name, err := r.target(rd.SourceFile)
+		if err != nil {
+			return err
+		}
+
+		if rd.Operator == "<&" {
+			switch {
+			case isAllDigits(name):
+				n, _ := strconv.Atoi(name)
+				return r.dup(rd.TargetFD, n)
+			case name == "-":
+				return r.close(rd.TargetFD)
+			}
+			return fmt.Errorf("%s: ambiguous redirect", rd.SourceFile)
+		}
+
+		flags := os.O_RDONLY
+		if rd.Operator == "<>" {
+			flags = os.O_RDWR | os.O_CREATE
+		}
+		file, err := r.open(name, flags)
+		if err != nil {
+			return err
+		}
+		return r.set(rd.TargetFD, file)
+
+	case *HereRedirection:
+		content := rd.Content
+		var err error
+		switch {
+		case rd.Operator == "<<<":
+			if content, err = r.s.expandString(rd.Word); err != nil {
+				return err
+			}
+			content += "\n"
+		case rd.Expand:
+			if content, err = r.s.expandHereDoc(content); err != nil {
+				return err
+			}
+		}
+
+		file, err := hereDocFile(content)
+		if err != nil {
+			return err
+		}
+		if !r.permanent {
+			r.opened = append(r.opened, file)
+		}
+		return r.set(rd.TargetFD, file)
+
+	case *RedirectionCloser:
+		return r.close(rd.TargetFD)
+	}
+	return fmt.Errorf("unsupported redirection: %s", redir)
+}
+
+// target expands the file name operand of a redirection, which must give
+// a single field.
+func (r *redirector) target(w *Word) (string, error) {
+	fields, err := r.s.expandWord(w)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) != 1 {
+		return "", fmt.Errorf("%s: ambiguous redirect", w)
+	}
+	return fields[0], nil
+}
+
+// path resolves name against the shell's working directory.
+func (r *redirector) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(r.s.workingDir, name)
+}
+
+func (r *redirector) open(name string, flags int) (*os.File, error) {
+	file, err := os.OpenFile(r.path(name), flags, 0644)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if !r.permanent {
+		r.opened = append(r.opened, file)
+	}
+	return file, nil
+}
+
+// openNoClobber opens name for > with noclobber set, which refuses to
+// truncate an existing regular file. Other files such as /dev/null are
+// opened without truncating them.
+func (r *redirector) openNoClobber(name string) (*os.File, error) {
+	file, err := r.open(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err == nil || !errors.Is(err, fs.ErrExist) {
+		return file, err
+	}
+	if info, err := os.Stat(r.path(name)); err == nil && !info.Mode().IsRegular() {
+		return r.open(name, os.O_WRONLY)
+	}
+	return nil, fmt.Errorf("%s: cannot overwrite existing file", name)
+}
+
+// get returns what is open on fd.
+func (r *redirector) get(fd int) (any, error) {
+	switch fd {
+	case 0:
+		return r.cio.Stdin, nil
+	case 1:
+		return r.cio.Stdout, nil
+	case 2:
+		return r.cio.Stderr, nil
+	}
+	if file := r.s.fds.GetFD(fd); file != nil {
+		return file, nil
+	}
+	return nil, fmt.Errorf("%d: %w", fd, ErrBadFileDescriptor)
+}
+
+// set opens stream on fd. Descriptors above 2, and with permanent all of
+// them, can only hold files.
+func (r *redirector) set(fd int, stream any) error {
+	if fd > 2 || r.permanent {
+		file, ok := stream.(*os.File)
+		if !ok {
+			return fmt.Errorf("%d: %w", fd, ErrBadFileDescriptor)
+		}
+		r.setFD(fd, file)
+	}
+
+	switch fd {
+	case 0:
+		reader, ok := stream.(io.Reader)
+		if !ok {
+			return fmt.Errorf("%d: %w", fd, ErrBadFileDescriptor)
+		}
+		r.cio.Stdin = reader
+	case 1, 2:
+		writer, ok := stream.(io.Writer)
+		if !ok {
+			return fmt.Errorf("%d: %w", fd, ErrBadFileDescriptor)
+		}
+		if fd == 1 {
+			r.cio.Stdout = writer
+		} else {
+			r.cio.Stderr = writer
+		}
+	}
+	return nil
+}
+
+// setFD replaces an entry of the shell's table. A permanent change closes
+// the file it replaces above fd 2, as the shell owns those.
+func (r *redirector) setFD(fd int, file *os.File) {
+	if r.permanent {
+		if old := r.s.fds.GetFD(fd); fd > 2 && old != nil && old != file {
+			old.Close()
+		}
+		r.s.fds.SetFD(fd, file)
+		return
+	}
+	if _, ok := r.saved[fd]; !ok {
+		r.saved[fd] = r.s.fds.GetFD(fd)
+	}
+	r.s.fds.SetFD(fd, file)
+}
+
+// dup makes fd a copy of from. A permanent copy involving a descriptor
+// above 2 gets a descriptor of its own, so that closing either later
+// leaves the other open.
+func (r *redirector) dup(fd, from int) error {
+	stream, err := r.get(from)
+	if err != nil {
+		return err
+	}
+	if file, ok := stream.(*os.File); ok && r.permanent && (fd > 2 || from > 2) && fd != from {
+		if stream, err = dupFile(file); err != nil {
+			return fmt.Errorf("%d: %w", from, err)
+		}
+	}
+	return r.set(fd, stream)
+}
+
+// close closes fd. The standard streams are replaced with the null device
+// opened the other way round instead, so that using them fails with EBADF
+// as it would on a closed descriptor.
+func (r *redirector) close(fd int) error {
+	if fd > 2 {
+		r.setFD(fd, nil)
+		return nil
+	}
+	flag := os.O_RDONLY
+	if fd == 0 {
+		flag = os.O_WRONLY
+	}
+	devNull, err := os.OpenFile(os.DevNull, flag, 0)
+	if err != nil {
+		return fmt.Errorf("%d: %w", fd, ErrBadFileDescriptor)
+	}
+	if !r.permanent {
+		r.opened = append(r.opened, devNull)
+	}
+	return r.set(fd, devNull)
+}
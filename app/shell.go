@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,23 +21,111 @@ import (
 type Shell struct {
 	term          *term.Terminal
 	termPrevState *term.State
-	jobs          map[int]*Pipeline
-	jobCounter    int
-	mu            sync.RWMutex
-	workingDir    string
-	env           map[string]string
-	builtins      map[string]BuiltinCmd
+	// input is where commands are read from: the terminal, or a script.
+	input LineSource
+	// tty is the terminal the shell controls jobs on, or -1 without job
+	// control.
+	tty  int
+	jobs map[int]*Job
+	// jobSeq numbers the uses of jobs, and jobEvents is signalled when
+	// one changes state. interrupts receives Ctrl-C while the shell has
+	// the terminal.
+	jobSeq     int
+	jobEvents  chan struct{}
+	interrupts chan struct{}
+	// jobChanges wakes the notifier of an interactive shell, which
+	// reports job changes under set -o notify while prompting is set.
+	jobChanges chan struct{}
+	promptMu   sync.Mutex
+	prompting  bool
+	// tabs counts the Tab presses in a row, so that a second one lists
+	// the completions.
+	tabs       int
+	mu         sync.RWMutex
+	workingDir string
+	env        map[string]string
+	exported   map[string]bool
+	positional []string
+	scriptName string
+	// fds holds the descriptors above 2 that commands inherit, and
+	// procSubs those opened for process substitutions, in order.
+	fds       *RedirectionHandler
+	procSubs  []int
+	builtins  map[string]BuiltinCmd
+	functions map[string]*FunctionDef
+	// shopts holds the options set with shopt, and options those set
+	// with set -o.
+	shopts        map[string]bool
+	options       map[string]bool
 	sigChan       chan os.Signal
 	lastExitCode  int
+	subshellLevel int
+	// substituted records that a command substitution ran while
+	// expanding the current command, and streams are the standard
+	// streams of that command, which substitutions inherit.
+	substituted bool
+	streams     CommandIO
+	// pgroup collects the processes started by a background job and
+	// lastBackground is the most recent such group, used for $!.
+	pgroup         *ProcessGroup
+	lastBackground *ProcessGroup
+	// loopDepth counts the loops being executed. A break, continue or
+	// return sets flow, and flowLevels holds how many loops a break or
+	// continue still has to leave.
+	loopDepth  int
+	flow       flowKind
+	flowLevels int
+	// funcDepth counts the function calls being executed, and locals
+	// holds for each of them the variables it shadowed with local.
+	funcDepth int
+	locals    []map[string]savedVar
+	// sourceDepth counts the files being run by source.
+	sourceDepth int
+	// login is set for a login shell, which reads the profile at startup.
+	login bool
+	// pid is $$, the process id of the shell, which a subshell in a
+	// process of its own shares.
+	pid int
 }
 
+// flowKind is a pending change of control flow that unwinds the commands
+// being executed.
+type flowKind int
+
+const (
+	flowNone flowKind = iota
+	flowBreak
+	flowContinue
+	flowReturn
+	// flowExit ends a subshell after exit.
+	flowExit
+	// flowInterrupt abandons the command line after a foreground job
+	// is interrupted from the terminal.
+	flowInterrupt
+)
+
 func (s *Shell) Close() {
-	term.Restore(int(os.Stdin.Fd()), s.termPrevState)
+	if s.termPrevState != nil {
+		term.Restore(int(os.Stdin.Fd()), s.termPrevState)
+	}
 }
 
-var promptDefault string = "$"
-var promptNextLine string = ">"
+// shoptNames lists the options shopt knows about, in listing order.
+var shoptNames = []string{"dotglob", "extglob", "failglob", "globstar", "nullglob"}
 
+// setOptionNames lists the options set -o knows about, in listing order,
+// and setOptionFlags the single letter flags for them.
+var setOptionNames = []string{"noclobber", "notify"}
+var setOptionFlags = map[rune]string{
+	'C': "noclobber",
+	'b': "notify",
+}
+
+var promptDefault string = "$ "
+var promptNextLine string = "> "
+
+// NewShell creates an interactive shell that reads commands from the
+// terminal on stdin.
 func NewShell() (*Shell, error) {
 	fd := int(os.Stdin.Fd())
 
@@ -41,286 +133,361 @@ func NewShell() (*Shell, error) {
 		return nil, errors.New("stdin is not a terminal")
 	}
 
-	t := term.NewTerminal(os.Stdin, "$ ")
+	shell, err := newShell()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := shell.initJobControl(fd); err != nil {
+		fmt.Fprintf(os.Stderr, "goson: no job control: %v\n", err)
+	}
 
-	prevState, err := term.MakeRaw(fd)
+	shell.term = term.NewTerminal(os.Stdin, promptDefault)
+	shell.input = shell.term
+	shell.term.AutoCompleteCallback = shell.complete
+	shell.jobChanges = make(chan struct{}, 1)
+	go shell.notifyJobs()
+	shell.termPrevState, err = term.MakeRaw(fd)
 	if err != nil {
 		return nil, fmt.Errorf("error setting raw mode: %w", err)
 	}
+	return shell, nil
+}
 
+// NewScriptShell creates a shell that runs the commands read from input
+// without a terminal, with name as $0 and args as the positional
+// parameters.
+func NewScriptShell(input LineSource, name string, args []string) (*Shell, error) {
+	shell, err := newShell()
+	if err != nil {
+		return nil, err
+	}
+	shell.input = input
+	shell.scriptName = name
+	shell.positional = args
+	return shell, nil
+}
+
+// newShell creates a shell with its variables and builtins set up but
+// without a terminal.
+func newShell() (*Shell, error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get working directory: %w", err)
 	}
 
 	shell := &Shell{
-		term:          t,
-		termPrevState: prevState,
-		jobs:          make(map[int]*Job),
-		jobCounter:    1,
-		env:           make(map[string]string),
-		workingDir:    wd,
-		lastExitCode:  0,
-		sigChan:       make(chan os.Signal, 1),
+		jobs:         make(map[int]*Job),
+		jobEvents:    make(chan struct{}, 1),
+		env:          make(map[string]string),
+		exported:     make(map[string]bool),
+		functions:    make(map[string]*FunctionDef),
+		fds:          NewRedirectionHandler(),
+		shopts:       make(map[string]bool),
+		options:      make(map[string]bool),
+		scriptName:   "goson",
+		workingDir:   wd,
+		tty:          -1,
+		lastExitCode: 0,
+		sigChan:      make(chan os.Signal, 1),
+		pid:          os.Getpid(),
 	}
 
+	if value, ok := os.LookupEnv(subshellPIDVar); ok {
+		if pid, err := strconv.Atoi(value); err == nil {
+			shell.pid = pid
+		}
+		os.Unsetenv(subshellPIDVar)
+	}
 	for _, env := range os.Environ() {
 		parts := strings.SplitN(env, "=", 2)
 		if len(parts) == 2 {
 			shell.env[parts[0]] = parts[1]
+			shell.exported[parts[0]] = true
 		}
 	}
+	for _, name := range shoptNames {
+		shell.shopts[name] = false
+	}
+	for _, name := range setOptionNames {
+		shell.options[name] = false
+	}
 	shell.env["SHELL"] = "goson"
+	shell.exported["SHELL"] = true
 
-	shell.builtins = map[string]BuiltinFunc{
-		"exit":    s.Exit,
-		"echo":    s.Echo,
-		"type":    s.Type,
-		"pwd":     s.Pwd,
-		"cd":      s.Cd,
-		"env":     s.Env,
-		"history": s.History,
-		"export":  s.Export,
-		"unset":   s.Unset,
-		"jobs":    s.Jobs,
-		"fg":      s.Fg,
-		"bg":      s.Bg,
-		"kill":    s.Kill,
+	shell.builtins = map[string]BuiltinCmd{
+		"exit":     (*Shell).ExitCmd,
+		":":        (*Shell).TrueCmd,
+		"true":     (*Shell).TrueCmd,
+		"false":    (*Shell).FalseCmd,
+		"echo":     (*Shell).EchoCmd,
+		"type":     (*Shell).TypeCmd,
+		"pwd":      (*Shell).PwdCmd,
+		"cd":       (*Shell).CdCmd,
+		"env":      (*Shell).EnvCmd,
+		"history":  (*Shell).HistoryCmd,
+		"export":   (*Shell).ExportCmd,
+		"unset":    (*Shell).UnsetCmd,
+		"set":      (*Shell).SetCmd,
+		"shopt":    (*Shell).ShoptCmd,
+		"break":    (*Shell).BreakCmd,
+		"continue": (*Shell).ContinueCmd,
+		"read":     (*Shell).ReadCmd,
+		"local":    (*Shell).LocalCmd,
+		"return":   (*Shell).ReturnCmd,
+		"exec":     (*Shell).ExecCmd,
+		"jobs":     (*Shell).JobsCmd,
+		"fg":       (*Shell).FgCmd,
+		"bg":       (*Shell).BgCmd,
+		"kill":     (*Shell).KillCmd,
+		"wait":     (*Shell).WaitCmd,
+		"disown":   (*Shell).DisownCmd,
+		"source":   (*Shell).SourceCmd,
+		".":        (*Shell).SourceCmd,
 	}
 	return shell, nil
 }
 
 func (s *Shell) Run() error {
+	// startup files run with the terminal in the mode the shell was
+	// started in, like any other command
+	term.Restore(int(os.Stdin.Fd()), s.termPrevState)
+	s.loadStartupFiles()
+	if _, err := term.MakeRaw(int(os.Stdin.Fd())); err != nil {
+		return fmt.Errorf("error setting raw mode: %w", err)
+	}
+
 	var inputSequence string
-	var parsedInputSeq *ParsedInputSequence
-	var currentInput string
 
 	for {
-		line, err := s.term.ReadLine()
+		// jobs that changed state are reported before the primary prompt,
+		// and by the notifier while it is shown
+		s.promptMu.Lock()
+		if inputSequence == "" {
+			s.reportJobs()
+		}
+		s.prompting = true
+		s.promptMu.Unlock()
+		line, err := s.input.ReadLine()
+		s.promptMu.Lock()
+		s.prompting = false
+		s.promptMu.Unlock()
 		if err != nil {
-			if err == io.EOF {
-				if inputSequence == "" {
-					// Likely Ctrl+D - exit
-					fmt.Fprint(s.term, "(Ctrl+D) received. Exiting\n")
-					os.Exit(0)
-				} else {
-					// Likely Ctrl+C - interrupt and continue
-					fmt.Fprint(s.term, "^C\n")
-					// if s. != nil {
-					//     s.currentCommand.Process.Signal(os.Interrupt)
-					// }
-					goto reset
-				}
-			} else {
+			if err != io.EOF {
 				return err
 			}
+			if inputSequence == "" {
+				// Likely Ctrl+D - exit
+				fmt.Fprint(s.term, "(Ctrl+D) received. Exiting\n")
+				return nil
+			}
+			// Likely Ctrl+C - interrupt and continue
+			fmt.Fprint(s.term, "^C\n")
+			inputSequence = ""
+			s.input.SetPrompt(promptDefault)
+			continue
 		}
 
-		inputSequence += " " + line
-		currentInput = strings.TrimSpace(inputSequence)
-		if line == "" {
+		if inputSequence != "" {
+			inputSequence += "\n"
+		}
+		inputSequence += line
+		currentInput := strings.TrimSpace(inputSequence)
+		if currentInput == "" {
+			inputSequence = ""
 			continue
 		}
 
-		parsedInputSeq, err = s.ParseInput(currentInput)
+		list, err := s.ParseInput(currentInput)
 		if err == ErrUnexpectedEnd {
-			s.term.SetPrompt(promptNextLine)
+			s.input.SetPrompt(promptNextLine)
 			continue
 		}
+		inputSequence = ""
+		s.input.SetPrompt(promptDefault)
 		if err != nil {
-			fmt.Fprintf(s.term, "parse error: %w\n", err)
-			goto reset
+			fmt.Fprintf(s.term, "parse error: %v\n", err)
+			s.lastExitCode = 2
+			continue
 		}
-		// fmt.Printf("parsed %#v\n%#v\n", command, redirects)
 
-		err = s.executeSequence(parsedInputSeq)
-		if err != nil {
-			fmt.Fprintf(s.term, "execution error: %v\n", err)
-			s.lastExitCode = 1
+		// commands run with the terminal in the mode the shell was started in
+		term.Restore(int(os.Stdin.Fd()), s.termPrevState)
+		s.executeList(list, s.stdio())
+		s.flow = flowNone
+		if _, err := term.MakeRaw(int(os.Stdin.Fd())); err != nil {
+			return fmt.Errorf("error setting raw mode: %w", err)
 		}
-		// handle job or command
-
-	reset:
-		inputSequence = ""
-		s.term.SetPrompt(promptDefault)
 	}
 }
 
-func (s *Shell) executeSequence(seq *ParsedInputSequence) error {
-	if len(seq.ParsedCommands) == 1 && len(seq.Operators) == 0 {
-		return s.executeCommand(&seq.ParsedCommands[0], false)
-	}
-
-	// Handle pipeline
-	return s.executePipeline(seq)
+// RunScript runs the commands read from s.input without prompts, as for a
+// script, a -c string or piped input, and returns the status of the last
+// one. A syntax error ends the script with status 2.
+func (s *Shell) RunScript() int {
+	s.loadStartupFiles()
+	return s.runLines(s.input, s.scriptName, s.stdio())
 }
 
-func (s *Shell) executeCommand(cmd *ParsedCommand, isSubshell bool) error {
-	// Execute external command
-	if cmd.isBackground {
-		// make a new subshell
-		if builtin, ok := s.builtins[cmd.Name]; ok {
-			builtin()
-			s.lastExitCode = builtin(cmd.Args)
-			return nil
-		}
-	} else {
-		if builtin, ok := s.builtins[cmd.Name]; ok {
-			builtin()
-			s.lastExitCode = builtin(cmd.Args)
-			return nil
-		}
-	}
-
-	return s.executeForegroundCommand(cmd)
-}
+// runLines runs the commands read from input until it ends, a syntax error
+// or a return, and returns the status of the last one. name prefixes the
+// syntax errors reported.
+func (s *Shell) runLines(input LineSource, name string, cio CommandIO) int {
+	var inputSequence string
+	lineNumber := 0
 
-type BuiltinCmd func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+	for s.flow == flowNone {
+		line, err := input.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				s.Write(cio.Stderr, fmt.Sprintf("%s: %v\n", name, err))
+				return 2
+			}
+			if strings.TrimSpace(inputSequence) != "" {
+				s.Write(cio.Stderr, fmt.Sprintf("%s: line %d: %v\n", name, lineNumber, ErrUnexpectedEnd))
+				return 2
+			}
+			return s.lastExitCode
+		}
+		lineNumber++
 
-func (s *Shell) handleSIGINT() {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+		if inputSequence != "" {
+			inputSequence += "\n"
+		}
+		inputSequence += line
+		currentInput := strings.TrimSpace(inputSequence)
+		if currentInput == "" {
+			inputSequence = ""
+			continue
+		}
 
-	for _, job := range s.jobs {
-		if !job.Background && job.Status == JobRunning {
-			job.ProcessGroup.Signal(syscall.SIGINT)
-			break
+		list, err := s.ParseInput(currentInput)
+		if err == ErrUnexpectedEnd {
+			continue
 		}
+		inputSequence = ""
+		if err != nil {
+			s.Write(cio.Stderr, fmt.Sprintf("%s: line %d: %v\n", name, lineNumber, err))
+			return 2
+		}
+		s.executeList(list, cio)
 	}
+	return s.lastExitCode
 }
 
-func (s *Shell) handleSIGTSTP() {
-	// Stop current foreground job
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	for _, job := range s.jobs {
-		if !job.Background && job.Status == JobRunning {
-			job.ProcessGroup.Signal(syscall.SIGTSTP)
-			job.Status = JobStopped
-			fmt.Printf("\n[%d]+  Stopped    %s\n", job.ID, job.String())
-			break
+// loadStartupFiles runs the profile of a login shell, ~/.goson_profile or
+// failing that ~/.profile, and then ~/.gosonrc in an interactive shell.
+// Files that don't exist are skipped.
+func (s *Shell) loadStartupFiles() {
+	home, ok := s.getVar("HOME")
+	if !ok || home == "" {
+		return
+	}
+	var files []string
+	if s.login {
+		for _, name := range []string{".goson_profile", ".profile"} {
+			if path := filepath.Join(home, name); isFile(path) {
+				files = append(files, path)
+				break
+			}
+		}
+	}
+	if s.interactive() {
+		if path := filepath.Join(home, ".gosonrc"); isFile(path) {
+			files = append(files, path)
 		}
 	}
+	for _, path := range files {
+		s.sourceFile(path, nil, s.stdio())
+	}
 }
 
-func (s *Shell) handleSIGCHLD() {
-	// Clean up completed background jobs
-	s.mu.Lock()
-	defer s.mu.Unlock()
+type BuiltinCmd func(s *Shell, args []string, io CommandIO) int
 
-	for id, job := range s.jobs {
-		if job.Background && job.Pipeline.IsCompleted() {
-			exitCode, _ := job.Pipeline.Wait()
-			job.Status = JobCompleted
-			fmt.Printf("[%d]   Done (%d)   %s\n", job.ID, exitCode, job.String())
-			delete(s.jobs, id)
-		}
-	}
+// interactive reports whether s reads commands from the terminal, rather
+// than running a script or a subshell.
+func (s *Shell) interactive() bool {
+	return s.term != nil && s.subshellLevel == 0
 }
 
-func (s *Shell) Write(stream io.Writer, str string) {
-	if stream == os.Stderr || stream == os.Stdout {
-		s.term.Write([]byte(str))
+// Write writes str to stream, through the terminal for the shell's own
+// standard streams. Writing to a pipe with no reader ends a subshell, such
+// as a pipeline stage, as SIGPIPE would end a process.
+func (s *Shell) Write(stream io.Writer, str string) error {
+	var err error
+	if s.term != nil && (stream == os.Stderr || stream == os.Stdout) {
+		_, err = s.term.Write([]byte(str))
 	} else {
-		fmt.Fprintf(stream, str)
+		_, err = fmt.Fprint(stream, str)
+	}
+	if errors.Is(err, syscall.EPIPE) && s.subshellLevel > 0 {
+		s.flow = flowExit
+	}
+	return err
+}
+
+// writeError reports a failed write by a builtin and returns its status. A
+// broken pipe is not reported, and gives the status of a process killed by
+// SIGPIPE.
+func (s *Shell) writeError(name string, err error, io CommandIO) int {
+	if errors.Is(err, syscall.EPIPE) {
+		return 128 + int(syscall.SIGPIPE)
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
 	}
+	s.Write(io.Stderr, fmt.Sprintf("%s: write error: %v\n", name, err))
+	return 1
 }
 
+// Command is one stage of a running pipeline.
 type Command struct {
-	Name     string
-	Args     []string
-	Stdin    io.Reader
-	Stdout   io.Writer
-	Stderr   io.Writer
-	extraFDs map[int]*os.File
-
-	Process  *os.Process
+	Node   Node
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// pipeEnds are closed once the stage finishes so the neighbouring
+	// stages see EOF or a broken pipe.
+	pipeEnds []*os.File
+
 	exitCode int
 	done     chan struct{}
 }
 
-func NewCommand(name string, args []string) *Command {
+func NewCommand(node Node, cio CommandIO) *Command {
 	return &Command{
-		Name:     name,
-		Args:     args,
-		Stdin:    os.Stdin,
-		Stdout:   os.Stdout,
-		Stderr:   os.Stderr,
-		extraFDs: make(map[int]*io.ReadWriter),
+		Node:     node,
+		Stdin:    cio.Stdin,
+		Stdout:   cio.Stdout,
+		Stderr:   cio.Stderr,
 		done:     make(chan struct{}),
 		exitCode: -1,
 	}
 }
 
-func (s *Shell) ExecutePipeline(commands []*Command) {
-	pipes := make([]*os.File, 0, (len(commands)-1)*2)
-	defer func() {
-		for _, pipe := range pipes {
-			pipe.Close()
-		}
-	}()
-
-	for i := 0; i < len(commands)-1; i++ {
-		r, w, err := os.Pipe()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating pipe: %v\n", err)
-			return
-		}
-		pipes = append(pipes, r, w)
-	}
-
-	// processes := make([]*exec.Cmd, len(commands))
-	// for i, command := range commands {
-	// 	var stdin, stdout *os.File = os.Stdin, os.Stdout
-
-	// 	if i > 0 {
-	// 		stdin = pipes[(i-1)*2]
-	// 	}
-	// 	if i < len(commands)-1 {
-	// 		stdout = pipes[i*2+1]
-	// 	}
-	// 	if builtin, exists := s.builtins[command.Name]; exists {
-	// 		processes[i] = s.createBuiltinSubshell(command, builtin, stdin, stdout, os.Stderr)
-	// 	} else {
-	// 		processes[i] = s.createExternalSubshell(command, stdin, stdout, os.Stderr)
-	// 	}
-	// }
-}
-
-func (s *Shell) executeCommand(command *Command) int {
-	if builtin, exists := s.builtins[command.Name]; exists {
-		exitCode := builtin(command.Args, command.done)
-		return exitCode
-	}
-
-	cmd := exec.Command(command.Name, command.Args...)
-	cmd.Stdin = command.io.Stdin
-	cmd.Stdout = command.io.Stdout
-	cmd.Stderr = command.io.Stderr
-
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			return exitError.ExitCode()
-		}
-		if _, ok := err.(*exec.Error); ok {
-			s.Write(command.io.Stderr, fmt.Sprintf("%s: executable not found"))
-			return 127
-		}
-		fmt.Fprintf(os.Stderr, "Error executing '%s': %v\n", command.Name, err)
+// ExecutePipeline runs every stage of seq concurrently and returns the exit
+// status of the last one.
+func (s *Shell) ExecutePipeline(seq *PipeSequence, cio CommandIO) int {
+	pipeline, err := NewPipeline(seq, cio)
+	if err != nil {
+		s.Write(cio.Stderr, fmt.Sprintf("Error creating pipe: %v\n", err))
 		return 1
 	}
-	return 0
+
+	pipeline.Start(s)
+	exitCode, _ := pipeline.Wait()
+	return exitCode
 }
 
 func (s *Shell) ExitCmd(args []string, io CommandIO) int {
 	if len(args) > 1 {
-		s.Write(io.Stderr, fmt.Sprintf("exit: %w\n", ErrTooManyArguments))
+		s.Write(io.Stderr, fmt.Sprintf("exit: %v\n", ErrTooManyArguments))
 		return 128
 	}
 
-	code := 0
-	if len(args) == 0 {
+	code := s.lastExitCode
+	if len(args) == 1 {
 		var err error
 		code, err = strconv.Atoi(args[0])
 		if err != nil {
@@ -328,13 +495,92 @@ func (s *Shell) ExitCmd(args []string, io CommandIO) int {
 			return 128
 		}
 	}
+	if s.subshellLevel > 0 {
+		s.flow = flowExit
+		return code
+	}
+	s.Close()
 	os.Exit(code)
 	return 0
 }
 
+// SourceCmd runs the commands of a file in the current shell, with any
+// further arguments as the positional parameters while it runs. A name
+// without a slash is looked up in PATH and then the working directory.
+func (s *Shell) SourceCmd(args []string, io CommandIO) int {
+	if len(args) == 0 {
+		s.Write(io.Stderr, "source: filename argument required\n")
+		return 2
+	}
+
+	path := args[0]
+	if !strings.Contains(path, "/") {
+		pathList, _ := s.getVar("PATH")
+		for _, dir := range strings.Split(pathList, ":") {
+			if candidate := filepath.Join(dir, path); isFile(candidate) {
+				path = candidate
+				break
+			}
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.workingDir, path)
+	}
+	if !isFile(path) {
+		s.Write(io.Stderr, fmt.Sprintf("source: %s: No such file or directory\n", args[0]))
+		return 1
+	}
+	return s.sourceFile(path, args[1:], io)
+}
+
+// sourceFile runs the commands in the file at path, as source does. A
+// return in the file ends it.
+func (s *Shell) sourceFile(path string, args []string, cio CommandIO) int {
+	f, err := os.Open(path)
+	if err != nil {
+		s.Write(cio.Stderr, fmt.Sprintf("source: %v\n", err))
+		return 1
+	}
+	defer f.Close()
+
+	if len(args) > 0 {
+		positional := s.positional
+		s.positional = slices.Clone(args)
+		defer func() { s.positional = positional }()
+	}
+	s.sourceDepth++
+	defer func() { s.sourceDepth-- }()
+
+	status := s.runLines(newReaderSource(bufio.NewReader(f)), path, cio)
+	if s.flow == flowReturn {
+		s.flow = flowNone
+	}
+	return status
+}
+
+// ExecCmd runs the command in place of the shell: the shell exits with its
+// status once it finishes, or a subshell ends. Without a command only the
+// redirections take effect, which executeSimpleCommand makes permanent.
+func (s *Shell) ExecCmd(args []string, io CommandIO) int {
+	if len(args) == 0 {
+		return 0
+	}
+
+	status := s.runExternal(args, io)
+	if s.subshellLevel > 0 {
+		s.flow = flowExit
+		return status
+	}
+	s.Close()
+	os.Exit(status)
+	return status
+}
+
 func (s *Shell) EchoCmd(args []string, io CommandIO) int {
 	str := strings.Join(args, " ") + "\n"
-	s.Write(io.Stdout, str)
+	if err := s.Write(io.Stdout, str); err != nil {
+		return s.writeError("echo", err, io)
+	}
 	return 0
 }
 
@@ -343,164 +589,456 @@ func (s *Shell) TypeCmd(args []string, io CommandIO) int {
 		return 0
 	}
 
+	status := 0
+	pathList, _ := s.getVar("PATH")
 	for _, arg := range args {
+		if fn, ok := s.functions[arg]; ok {
+			s.Write(io.Stdout, fmt.Sprintf("%s is a function\n%s\n", arg, fn))
+			continue
+		}
 		if _, ok := s.builtins[arg]; ok {
 			s.Write(io.Stdout, fmt.Sprintf("%s is a shell builtin\n", arg))
 			continue
 		}
-		if file, ok := findInPath(arg); ok {
+		if file, ok := findInPath(arg, pathList); ok {
 			s.Write(io.Stdout, fmt.Sprintf("%s is %s\n", arg, file))
 			continue
 		} else {
-			s.Write(io.Stderr, fmt.Sprintf("type: %s: not found\n", arg)) // inconsistent error
+			s.Write(io.Stderr, fmt.Sprintf("%s: not found\n", arg))
+			status = 1
 		}
 	}
+	return status
+}
+
+// TrueCmd implements : and true, which do nothing successfully.
+func (s *Shell) TrueCmd(args []string, io CommandIO) int {
 	return 0
 }
 
+func (s *Shell) FalseCmd(args []string, io CommandIO) int {
+	return 1
+}
+
 func (s *Shell) PwdCmd(args []string, io CommandIO) int {
-	pwd, err := os.Getwd()
-	if err != nil {
-		s.Write(io.Stderr, fmt.Sprintf("pwd: %w\n", err))
-		return 1
-	}
-	s.Write(io.Stdout, pwd+"\n")
+	s.Write(io.Stdout, s.workingDir+"\n")
 	return 0
 }
 
 func (s *Shell) CdCmd(args []string, io CommandIO) int {
 	var dir string
 	if len(args) == 0 {
-		dir = os.Getenv("HOME")
+		dir = s.env["HOME"]
 	} else {
 		dir = args[0]
 	}
 
 	if len(args) > 1 {
-		s.Write(io.Stderr, fmt.Sprintf("cd: %w\n", ErrTooManyArguments))
+		s.Write(io.Stderr, fmt.Sprintf("cd: %v\n", ErrTooManyArguments))
 		return 1
 	}
 
-	if dir[0] == '~' {
-		HOME := os.Getenv("HOME")
-		dir = strings.Replace(dir, "~", HOME, 1)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.workingDir, dir)
 	}
-	if err := os.Chdir(dir); err != nil {
-		s.Write(io.Stderr, fmt.Sprintf("cd: %s: No such file or directory", dir))
-		return 127
+	// the process stays where it is; subshells have their own workingDir
+	info, err := os.Stat(dir)
+	if err != nil {
+		s.Write(io.Stderr, fmt.Sprintf("cd: %s: No such file or directory\n", dir))
+		return 1
+	}
+	if !info.IsDir() {
+		s.Write(io.Stderr, fmt.Sprintf("cd: %s: Not a directory\n", dir))
+		return 1
 	}
+	s.env["OLDPWD"] = s.workingDir
+	s.workingDir = dir
+	s.env["PWD"] = dir
 	return 0
 }
 
-func (s *Shell) envCmd(args []string, io CommandIO) int {
-	env := os.Environ()
-	for _, e := range env {
-		s.Write(io.Stdout, e)
+func (s *Shell) EnvCmd(args []string, io CommandIO) int {
+	for _, e := range s.environ(nil) {
+		s.Write(io.Stdout, e+"\n")
 	}
 	return 0
 }
 
-func (s *Shell) HistoryCmd(args []string, io CommandIO) int {
-	if len(args) > 1 {
-		s.Write(io.Stderr, fmt.Sprintf("history: %w\n", ErrTooManyArguments))
-		return 128
+func (s *Shell) ExportCmd(args []string, io CommandIO) int {
+	if len(args) == 0 {
+		for _, name := range slices.Sorted(maps.Keys(s.exported)) {
+			if value, ok := s.getVar(name); ok {
+				s.Write(io.Stdout, fmt.Sprintf("declare -x %s=%s\n", name, shellQuote(value)))
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isName(name) {
+			s.Write(io.Stderr, fmt.Sprintf("export: `%s': not a valid identifier\n", arg))
+			status = 1
+			continue
+		}
+		if hasValue {
+			s.setVar(name, value)
+		}
+		s.exportVar(name)
+	}
+	return status
+}
+
+// UnsetCmd removes variables, or functions with -f.
+func (s *Shell) UnsetCmd(args []string, io CommandIO) int {
+	functions := false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		switch args[0] {
+		case "-f":
+			functions = true
+		case "-v":
+			functions = false
+		default:
+			s.Write(io.Stderr, fmt.Sprintf("unset: %s: invalid option\nunset: usage: unset [-f] [-v] [name ...]\n", args[0]))
+			return 2
+		}
+		args = args[1:]
 	}
 
-	var offset = 0
+	for _, arg := range args {
+		if functions {
+			delete(s.functions, arg)
+		} else {
+			s.unsetVar(arg)
+		}
+	}
+	return 0
+}
+
+// LocalCmd gives variables a value that lasts until the current function
+// returns. Functions it calls see the local value.
+func (s *Shell) LocalCmd(args []string, io CommandIO) int {
+	if s.funcDepth == 0 {
+		s.Write(io.Stderr, "local: can only be used in a function\n")
+		return 1
+	}
+
+	frame := s.locals[len(s.locals)-1]
 	if len(args) == 0 {
-		num, err := strconv.Atoi(args[0])
-		offset = s.term.History.Len() - num
+		for _, name := range slices.Sorted(maps.Keys(frame)) {
+			if value, ok := s.getVar(name); ok {
+				s.Write(io.Stdout, fmt.Sprintf("%s=%s\n", name, shellQuote(value)))
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isName(name) {
+			s.Write(io.Stderr, fmt.Sprintf("local: `%s': not a valid identifier\n", arg))
+			status = 1
+			continue
+		}
+		if _, ok := frame[name]; !ok {
+			frame[name] = s.saveVar(name)
+		}
+		if hasValue {
+			s.setVar(name, value)
+		} else {
+			delete(s.env, name)
+		}
+	}
+	return status
+}
+
+// ReturnCmd leaves the current function with the given status, or that of
+// the last command.
+func (s *Shell) ReturnCmd(args []string, io CommandIO) int {
+	if s.funcDepth == 0 && s.sourceDepth == 0 {
+		s.Write(io.Stderr, "return: can only `return' from a function or sourced script\n")
+		return 1
+	}
+	if len(args) > 1 {
+		s.Write(io.Stderr, fmt.Sprintf("return: %v\n", ErrTooManyArguments))
+		return 1
+	}
+
+	status := s.lastExitCode
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
 		if err != nil {
-			s.Write(io.Stderr, fmt.Sprintf("history: Illegal number: %s", args[0]))
-			return 2
+			s.Write(io.Stderr, fmt.Sprintf("return: %s: numeric argument required\n", args[0]))
+			n = 2
+		}
+		status = n & 0xff
+	}
+	s.flow = flowReturn
+	return status
+}
+
+// SetCmd turns options on with -o name or their flags and off with +o name
+// or +flag, then replaces the positional parameters with any arguments
+// left. Without arguments it lists the shell variables.
+func (s *Shell) SetCmd(args []string, io CommandIO) int {
+	if len(args) == 0 {
+		for _, name := range slices.Sorted(maps.Keys(s.env)) {
+			s.Write(io.Stdout, fmt.Sprintf("%s=%s\n", name, shellQuote(s.env[name])))
+		}
+		return 0
+	}
+
+	replace := false
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			replace = true
+			break
+		}
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			break
+		}
+		args = args[1:]
+		on := arg[0] == '-'
+
+		if arg[1:] == "o" {
+			if len(args) == 0 {
+				s.listOptions(on, io)
+				continue
+			}
+			name := args[0]
+			args = args[1:]
+			if _, ok := s.options[name]; !ok {
+				s.Write(io.Stderr, fmt.Sprintf("set: %s: invalid option name\n", name))
+				return 1
+			}
+			s.options[name] = on
+			continue
+		}
+		for _, c := range arg[1:] {
+			name, ok := setOptionFlags[c]
+			if !ok {
+				s.Write(io.Stderr, fmt.Sprintf("set: %c%c: invalid option\nset: usage: set [-C] [-o option-name] [--] [arg ...]\n", arg[0], c))
+				return 2
+			}
+			s.options[name] = on
 		}
 	}
 
-	for i := offset; i < s.term.History.Len(); i++ {
-		s.Write(io.Stdout, fmt.Sprintf("%d  %s", i+1, s.term.History.At(i)))
+	if replace || len(args) > 0 {
+		s.positional = slices.Clone(args)
 	}
 	return 0
 }
 
-func handleRedirections(cmdWR CommandWRedirections) (*Command, error) {
-	var pcommand = cmdWR.Command
-	for _, redir := range cmdWR.Redirections {
-		switch redir.Operator {
-		case ">", ">>":
-			var targetStream *io.Writer
-
-			if fd, ok := redir.Source.(int); ok {
-				switch fd {
-				case 1:
-					targetStream = &pcommand.io.Stdout
-				case 2:
-					targetStream = &pcommand.io.Stderr
-				default:
-					file := getFileFromFD(fd)
-					if file != nil {
-						var a io.Writer = file
-						targetStream = &a
-					} else {
-						return nil, fmt.Errorf("redirection error: cannot get file for FD: %d", fd)
-					}
-				}
-			} else {
-				return nil, fmt.Errorf("redirection error: invalid source FD: %v", redir.Source)
+// listOptions prints the set -o options, as commands that restore them
+// for set +o.
+func (s *Shell) listOptions(table bool, io CommandIO) {
+	for _, name := range setOptionNames {
+		on := s.options[name]
+		if !table {
+			flag := "+o"
+			if on {
+				flag = "-o"
 			}
+			s.Write(io.Stdout, fmt.Sprintf("set %s %s\n", flag, name))
+			continue
+		}
+		state := "off"
+		if on {
+			state = "on"
+		}
+		s.Write(io.Stdout, fmt.Sprintf("%-15s\t%s\n", name, state))
+	}
+}
 
-			var destFile *os.File
-			if fd, ok := redir.Destination.(int); ok {
-				destFile = getFileFromFD(fd)
-			} else {
-				flags := os.O_WRONLY | os.O_CREATE
-				if redir.Operator == ">>" {
-					flags |= os.O_APPEND
-				} else {
-					flags |= os.O_TRUNC
-				}
-				var err error
-				destFile, err = os.OpenFile(redir.Destination.(string), flags, 0644)
-				if err != nil {
-					return nil, fmt.Errorf("redirection error: cannot open file %s: %v", redir.Destination, err)
-				}
+func (s *Shell) ShoptCmd(args []string, io CommandIO) int {
+	var mode rune
+	print, quiet := false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 's', 'u':
+				mode = c
+			case 'p':
+				print = true
+			case 'q':
+				quiet = true
+			default:
+				s.Write(io.Stderr, fmt.Sprintf("shopt: -%c: invalid option\nshopt: usage: shopt [-pqsu] [optname ...]\n", c))
+				return 2
 			}
-			*targetStream = destFile
-
-		case "<":
-			var targetStream *io.Reader
-
-			if fd, ok := redir.Destination.(int); ok {
-				switch fd {
-				case 0:
-					targetStream = &pcommand.io.Stdin
-				default:
-					return nil, fmt.Errorf("redirection error: unsupported target FD: %d", fd)
-				}
-			} else {
-				return nil, fmt.Errorf("redirection error: invalid target FD: %s", redir.Source)
+		}
+		args = args[1:]
+	}
+
+	names := args
+	if len(names) == 0 {
+		for _, name := range shoptNames {
+			if mode == 0 || s.shopts[name] == (mode == 's') {
+				names = append(names, name)
 			}
+		}
+	}
+
+	status := 0
+	for _, name := range names {
+		on, ok := s.shopts[name]
+		if !ok {
+			s.Write(io.Stderr, fmt.Sprintf("shopt: %s: invalid shell option name\n", name))
+			status = 1
+			continue
+		}
+		if mode != 0 && len(args) > 0 {
+			s.shopts[name] = mode == 's'
+			continue
+		}
+		if !on && len(args) > 0 {
+			status = 1
+		}
+		if quiet {
+			continue
+		}
 
-			var sourceFile *os.File
-			if fd, ok := redir.Source.(int); ok {
-				sourceFile = getFileFromFD(fd)
-			} else {
-				var err error
-				sourceFile, err = os.OpenFile(redir.Source.(string), os.O_RDONLY, 0644)
-				if err != nil {
-					return nil, fmt.Errorf("redirection error: cannot open file %s: %v", redir.Source, err)
-				}
+		if print {
+			flag := "-u"
+			if on {
+				flag = "-s"
 			}
-			*targetStream = sourceFile
+			s.Write(io.Stdout, fmt.Sprintf("shopt %s %s\n", flag, name))
+		} else {
+			state := "off"
+			if on {
+				state = "on"
+			}
+			s.Write(io.Stdout, fmt.Sprintf("%-15s\t%s\n", name, state))
+		}
+	}
+	return status
+}
+
+func (s *Shell) BreakCmd(args []string, io CommandIO) int {
+	return s.loopControl("break", flowBreak, args, io)
+}
+
+func (s *Shell) ContinueCmd(args []string, io CommandIO) int {
+	return s.loopControl("continue", flowContinue, args, io)
+}
 
+// loopControl implements break and continue, which leave or restart the
+// nth enclosing loop.
+func (s *Shell) loopControl(name string, kind flowKind, args []string, io CommandIO) int {
+	if len(args) > 1 {
+		s.Write(io.Stderr, fmt.Sprintf("%s: %v\n", name, ErrTooManyArguments))
+		return 1
+	}
+	n := 1
+	if len(args) == 1 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil {
+			s.Write(io.Stderr, fmt.Sprintf("%s: %s: numeric argument required\n", name, args[0]))
+			return 128
+		}
+		if n < 1 {
+			s.Write(io.Stderr, fmt.Sprintf("%s: %d: loop count out of range\n", name, n))
+			return 1
+		}
+	}
+	if s.loopDepth == 0 {
+		s.Write(io.Stderr, fmt.Sprintf("%s: only meaningful in a `for', `while', or `until' loop\n", name))
+		return 0
+	}
+
+	s.flow = kind
+	s.flowLevels = min(n, s.loopDepth)
+	return 0
+}
+
+// ReadCmd reads a line from standard input and assigns its IFS separated
+// fields to the named variables, the last one taking the rest of the line.
+func (s *Shell) ReadCmd(args []string, io CommandIO) int {
+	raw := false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		switch args[0] {
+		case "-r":
+			raw = true
+		case "-p":
+			if len(args) < 2 {
+				s.Write(io.Stderr, "read: -p: option requires an argument\n")
+				return 2
+			}
+			s.Write(io.Stderr, args[1])
+			args = args[1:]
 		default:
-			return nil, fmt.Errorf("unsupported redirection operator: %s", redir.Operator)
+			s.Write(io.Stderr, fmt.Sprintf("read: %s: invalid option\nread: usage: read [-r] [-p prompt] [name ...]\n", args[0]))
+			return 2
+		}
+		args = args[1:]
+	}
+	for _, name := range args {
+		if !isName(name) {
+			s.Write(io.Stderr, fmt.Sprintf("read: `%s': not a valid identifier\n", name))
+			return 1
+		}
+	}
+
+	line, complete := readLine(io.Stdin, raw)
+	if len(args) == 0 {
+		s.setVar("REPLY", line)
+	} else {
+		ifs, ok := s.getVar("IFS")
+		if !ok {
+			ifs = " \t\n"
+		}
+		fields := splitReadFields(line, ifs, len(args))
+		for i, name := range args {
+			value := ""
+			if i < len(fields) {
+				value = fields[i]
+			}
+			s.setVar(name, value)
+		}
+	}
+	if !complete {
+		return 1
+	}
+	return 0
+}
+
+func (s *Shell) HistoryCmd(args []string, io CommandIO) int {
+	if len(args) > 1 {
+		s.Write(io.Stderr, fmt.Sprintf("history: %v\n", ErrTooManyArguments))
+		return 128
+	}
+
+	if s.term == nil {
+		return 0
+	}
+	total := s.term.History.Len()
+	count := total
+	if len(args) == 1 {
+		num, err := strconv.Atoi(args[0])
+		if err != nil {
+			s.Write(io.Stderr, fmt.Sprintf("history: Illegal number: %s\n", args[0]))
+			return 2
 		}
+		count = min(num, total)
 	}
 
-	return pcommand, nil
+	// History.At(0) is the most recent entry
+	for i := count - 1; i >= 0; i-- {
+		s.Write(io.Stdout, fmt.Sprintf("%5d  %s\n", total-i, s.term.History.At(i)))
+	}
+	return 0
 }
 
 var ErrUnexpectedEnd = errors.New("unexpected end of input")
 var ErrBadFileDescriptor = errors.New("bad file descriptor")
 var ErrTooManyArguments = errors.New("too many arguments")
-var ErrNoRedirectionFile = errors.New("no filename or fd")
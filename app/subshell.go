@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// subshellPIDVar passes $$ to a subshell running in a process of its own.
+const subshellPIDVar = "GOSON_SUBSHELL_PID"
+
+// subshell returns a copy of the shell whose variables and working
+// directory can change without affecting s.
+func (s *Shell) subshell() *Shell {
+	return &Shell{
+		term:          s.term,
+		termPrevState: s.termPrevState,
+		tty:           s.tty,
+		jobs:          s.inheritedJobs(),
+		jobSeq:        s.jobSeq,
+		jobEvents:     make(chan struct{}, 1),
+		workingDir:    s.workingDir,
+		env:           maps.Clone(s.env),
+		exported:      maps.Clone(s.exported),
+		positional:    slices.Clone(s.positional),
+		scriptName:    s.scriptName,
+		fds:           s.fds.Clone(),
+		builtins:      s.builtins,
+		functions:     maps.Clone(s.functions),
+		shopts:        maps.Clone(s.shopts),
+		options:       maps.Clone(s.options),
+		lastExitCode:  s.lastExitCode,
+		subshellLevel: s.subshellLevel + 1,
+		loopDepth:     s.loopDepth,
+		funcDepth:     s.funcDepth,
+		sourceDepth:   s.sourceDepth,
+		pid:           s.pid,
+		// locals saved in the subshell never need restoring
+		locals: make([]map[string]savedVar, len(s.locals)),
+
+		pgroup:         s.pgroup,
+		lastBackground: s.lastBackground,
+	}
+}
+
+// executeSubshell runs a ( list ) in a copy of the shell, so that changes
+// to variables, functions, options and the working directory stay inside
+// it. Inside a background job the list runs in a separate process instead,
+// which can be signalled along with the rest of the job.
+func (s *Shell) executeSubshell(list *CommandList, cio CommandIO) int {
+	if s.pgroup != nil {
+		return s.reexecSubshell(list, cio)
+	}
+	return s.subshell().executeList(list, cio)
+}
+
+// reexecSubshell runs list in a new process running this binary with -c.
+// Exported variables reach it through the environment and the rest of the
+// state it can see is recreated by the script from subshellScript.
+func (s *Shell) reexecSubshell(list *CommandList, cio CommandIO) int {
+	self, err := os.Executable()
+	if err != nil {
+		s.Write(cio.Stderr, fmt.Sprintf("subshell: %v\n", err))
+		return 126
+	}
+
+	args := append([]string{"-c", s.subshellScript(list), s.scriptName}, s.positional...)
+	cmd := exec.Command(self, args...)
+	cmd.Stdin = cio.Stdin
+	cmd.Stdout = cio.Stdout
+	cmd.Stderr = cio.Stderr
+	cmd.ExtraFiles = s.fds.ExtraFiles()
+	cmd.Env = append(s.environ(nil), subshellPIDVar+"="+strconv.Itoa(s.pid))
+	cmd.Dir = s.workingDir
+	return s.runProcess("subshell", cmd)
+}
+
+// subshellScript returns list preceded by the commands that recreate the
+// shell variables, functions, options and exit status of s.
+func (s *Shell) subshellScript(list *CommandList) string {
+	var sb strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(s.env)) {
+		if !s.exported[name] && isName(name) {
+			fmt.Fprintf(&sb, "%s=%s\n", name, shellQuote(s.env[name]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.functions)) {
+		sb.WriteString(s.functions[name].String())
+		sb.WriteString("\n")
+	}
+	for _, name := range shoptNames {
+		if s.shopts[name] {
+			fmt.Fprintf(&sb, "shopt -s %s\n", name)
+		}
+	}
+	for _, name := range setOptionNames {
+		if s.options[name] {
+			fmt.Fprintf(&sb, "set -o %s\n", name)
+		}
+	}
+	// $? is set last, as each command before it sets it too
+	if s.lastExitCode != 0 {
+		fmt.Fprintf(&sb, "(exit %d)\n", s.lastExitCode)
+	}
+	sb.WriteString(list.String())
+	return sb.String()
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 )
 
-var PATH = os.Getenv("PATH")
-var paths = strings.Split(PATH, ":")
-
-func findInPath(cmd string) (string, bool) {
-	for _, path := range paths {
+// findInPath returns the first executable named cmd in the colon separated
+// directories of pathList, as given by $PATH.
+func findInPath(cmd, pathList string) (string, bool) {
+	for _, path := range pathDirs(pathList) {
 		filePath := filepath.Join(path, cmd)
 		fileInfo, err := os.Stat(filePath)
 		if err == nil && fileInfo.Mode().Perm()&0111 != 0 {
@@ -21,112 +21,89 @@ func findInPath(cmd string) (string, bool) {
 	return "", false
 }
 
-
-type RedirectionHandler struct {
-	fds map[int]*os.File
+// pathDirs returns the directories of pathList, searched in order for
+// commands.
+func pathDirs(pathList string) []string {
+	return strings.Split(pathList, ":")
 }
 
-func NewRedirectionHandler() *RedirectionHandler {
-	return &RedirectionHandler{
-		fds: map[int]*os.File{
-			0: os.Stdin,
-			1: os.Stdout,
-			2: os.Stderr,
-		},
-	}
+// isFile reports whether path names an existing file that isn't a
+// directory.
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
 }
 
-func (rh *RedirectionHandler) Close() error {
-	var lastErr error
-	for fd, file := range rh.fds {
-		if fd > 2 && file != nil {
-			if err := file.Close(); err != nil {
-				lastErr = err
-			}
-		}
+// shellQuote quotes s so that the shell reads it back as a single word.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
 	}
-	return lastErr
-}
-
-func (rh *RedirectionHandler) GetFD(fd int) *os.File {
-	if file, ok := rh.fds[fd]; ok {
-		return file
+	if !strings.ContainsAny(s, " \t\n'\"\\$`|&;<>()*?[]{}~#!") {
+		return s
 	}
-	return nil
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
-func (rh *RedirectionHandler) SetFD(fd int, file *os.File) {
-	rh.fds[fd] = file
-}
+// readLine reads up to the next newline one byte at a time, so nothing
+// past the line is consumed from a shared input. Unless raw is set a
+// backslash escapes the next character and joins continued lines.
+// complete is false when the input ended before a newline.
+func readLine(r io.Reader, raw bool) (line string, complete bool) {
+	var sb strings.Builder
+	buf := make([]byte, 1)
+	escaped := false
+	for {
+		n, err := r.Read(buf)
+		if n == 0 {
+			if err != nil {
+				return sb.String(), false
+			}
+			continue
+		}
 
-func getFileFromFD(fd int) *os.File {
-	switch fd {
-	case -1:
-		devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
-		return devNull
-	case 0:
-		return os.Stdin
-	case 1:
-		return os.Stdout
-	case 2:
-		return os.Stderr
-	default:
-		fileName := fmt.Sprintf("/dev/fd/%d", fd)
-		return os.NewFile(uintptr(fd), fileName)
+		c := buf[0]
+		switch {
+		case escaped:
+			escaped = false
+			if c != '\n' {
+				sb.WriteByte(c)
+			}
+		case c == '\\' && !raw:
+			escaped = true
+		case c == '\n':
+			return sb.String(), true
+		default:
+			sb.WriteByte(c)
+		}
 	}
 }
 
-func HandleRedirections(cmdWR CommandWRedirections) (*Command, error) {
-	var pcommand = cmdWR.Command
-	for _, redir := range cmdWR.Redirections {
-		switch redir.Operator {
-		case ">", ">>":
-			sourceFD, _ := redir.Source.(int)
-
-			var destFile *os.File
-			var err error
-			if destFD, ok := redir.Destination.(int); ok {
-				destFile = getFileFromFD(destFD)
-			} else {
-				filename := redir.Destination.(string)
-				flags := os.O_WRONLY | os.O_CREATE
-				if redir.Operator == ">>" {
-					flags |= os.O_APPEND
-				} else {
-					flags |= os.O_TRUNC
-				}
-				destFile, err = os.OpenFile(filename, flags, 0644)
-				if err != nil {
-					return pcommand, fmt.Errorf("cannot open file %s: %v", filename, err)
-				}
-			}
-			pcommand.redirHandler.SetFD(sourceFD, destFile)
-
-		case "<":
-			destFD, _ := redir.Destination.(int)
+// splitReadFields splits line on IFS into at most n fields for read. IFS
+// whitespace around the line is dropped and the last field keeps the rest
+// of the line, separators included.
+func splitReadFields(line, ifs string, n int) []string {
+	isIFS := func(r rune) bool { return strings.ContainsRune(ifs, r) }
+	isSpace := func(r rune) bool { return isIFS(r) && (r == ' ' || r == '\t' || r == '\n') }
 
-			var sourceFile *os.File
-			var err error
-			if sourceFD, ok := redir.Source.(int); ok {
-				sourceFile = getFileFromFD(sourceFD)
-			} else {
-				filename := redir.Source.(string)
-				sourceFile, err = os.OpenFile(filename, os.O_RDONLY, 0)
-				if err != nil {
-					return pcommand, fmt.Errorf("cannot open file %s: %v", filename, err)
-				}
-			}
-			pcommand.redirHandler.SetFD(destFD, sourceFile)
+	line = strings.TrimFunc(line, isSpace)
+	var fields []string
+	for len(fields) < n-1 && line != "" {
+		i := strings.IndexFunc(line, isIFS)
+		if i < 0 {
+			break
+		}
+		fields = append(fields, line[:i])
 
-		case "<<":
-			return rp.handleHeredoc(redir)
-		case "<<<":
-			return rp.handleHereString(redir)
-		case "<>":
-			return pcommand, fmt.Errorf("unsupported redirection operator: %s", redir.Operator)
-		default:
-			return pcommand, fmt.Errorf("unsupported redirection operator: %s", redir.Operator)
+		// a separator is IFS whitespace around at most one other IFS
+		// character
+		line = strings.TrimLeftFunc(line[i:], isSpace)
+		if r, size := utf8.DecodeRuneInString(line); line != "" && isIFS(r) {
+			line = strings.TrimLeftFunc(line[size:], isSpace)
 		}
 	}
-	return pcommand, nil
+	if line != "" {
+		fields = append(fields, line)
+	}
+	return fields
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+)
+
+func (s *Shell) getVar(name string) (string, bool) {
+	value, ok := s.env[name]
+	return value, ok
+}
+
+func (s *Shell) setVar(name, value string) {
+	s.env[name] = value
+}
+
+func (s *Shell) unsetVar(name string) {
+	delete(s.env, name)
+	delete(s.exported, name)
+}
+
+func (s *Shell) exportVar(name string) {
+	s.exported[name] = true
+}
+
+// savedVar is the state of a variable before it was temporarily replaced.
+type savedVar struct {
+	value    string
+	set      bool
+	exported bool
+}
+
+func (s *Shell) saveVar(name string) savedVar {
+	value, ok := s.getVar(name)
+	return savedVar{value: value, set: ok, exported: s.exported[name]}
+}
+
+func (s *Shell) restoreVar(name string, old savedVar) {
+	if !old.set {
+		s.unsetVar(name)
+		if old.exported {
+			s.exportVar(name)
+		}
+		return
+	}
+	s.setVar(name, old.value)
+	if old.exported {
+		s.exportVar(name)
+	} else {
+		delete(s.exported, name)
+	}
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupParam resolves a variable, a special parameter or a positional
+// parameter by name.
+func (s *Shell) lookupParam(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(s.lastExitCode), true
+	case "$":
+		return strconv.Itoa(s.pid), true
+	case "!":
+		if s.lastBackground == nil {
+			return "", false
+		}
+		pid := s.lastBackground.FirstPID()
+		if pid <= 0 {
+			return "", false
+		}
+		return strconv.Itoa(pid), true
+	case "#":
+		return strconv.Itoa(len(s.positional)), true
+	case "0":
+		return s.scriptName, true
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(s.positional) {
+			return "", false
+		}
+		return s.positional[n-1], true
+	}
+	return s.getVar(name)
+}